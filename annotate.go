@@ -0,0 +1,345 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// Reading speeds for the reading time estimate: words per minute for
+	// space-separated scripts, characters per minute for Chinese and Japanese.
+	readingWordsPerMinute = 230
+	readingCharsPerMinute = 500
+
+	// outlineIDPrefix namespaces heading anchors so article markup cannot
+	// collide with element IDs of the page it is shown in.
+	outlineIDPrefix = "reader-"
+
+	// languageSampleWords bounds the text examined for language detection;
+	// the opening of an article is plenty.
+	languageSampleWords = 2000
+	languageMinHits     = 8
+)
+
+// outlineEntry is one heading of an article's table of contents. ID is the
+// anchor of the heading within readerResponse.Content.
+type outlineEntry struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+}
+
+// annotateArticle fills in the word count, reading time, language and outline
+// of a sanitized article, giving every heading in Content an anchor ID.
+// declaredLang is the page's own lang attribute, used when the text is too
+// short or too mixed to tell.
+func annotateArticle(article *readerResponse, declaredLang string) {
+	stats := measureText(article.TextContent)
+	article.WordCount = stats.words + stats.ideographs
+	if article.WordCount > 0 {
+		minutes := float64(stats.words)/readingWordsPerMinute + float64(stats.ideographs)/readingCharsPerMinute
+		article.ReadingMinutes = max(1, int(math.Ceil(minutes)))
+	}
+	article.Language = stats.language()
+	if article.Language == "" {
+		article.Language = normalizeLanguageTag(declaredLang)
+	}
+
+	if strings.TrimSpace(article.Content) == "" {
+		return
+	}
+	root, err := parseArticleHTML(article.Content)
+	if err != nil {
+		return
+	}
+	article.Outline = anchorHeadings(root)
+	if len(article.Outline) == 0 {
+		return
+	}
+	var b strings.Builder
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&b, c); err != nil {
+			article.Outline = nil
+			return
+		}
+	}
+	article.Content = b.String()
+}
+
+// anchorHeadings gives each non-empty heading under root a unique ID derived
+// from its text and returns them in document order. In-article links to a
+// heading's previous ID are pointed at the new one.
+func anchorHeadings(root *html.Node) []outlineEntry {
+	var outline []outlineEntry
+	used := make(map[string]bool)
+	renamed := make(map[string]string)
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				text := strings.Join(strings.Fields(textContent(n)), " ")
+				if text == "" {
+					break
+				}
+				slug := outlineIDPrefix + slugify(text)
+				id := slug
+				for i := 2; used[id]; i++ {
+					id = slug + "-" + strconv.Itoa(i)
+				}
+				used[id] = true
+				if old := setAttr(n, "id", id); old != "" {
+					renamed[old] = id
+				}
+				outline = append(outline, outlineEntry{Level: int(n.Data[1] - '0'), ID: id, Text: text})
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	if len(renamed) > 0 {
+		var relink func(*html.Node)
+		relink = func(n *html.Node) {
+			if n.Type == html.ElementNode && n.DataAtom == atom.A {
+				for i, a := range n.Attr {
+					if target, ok := strings.CutPrefix(a.Val, "#"); a.Key == "href" && ok && renamed[target] != "" {
+						n.Attr[i].Val = "#" + renamed[target]
+					}
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				relink(c)
+			}
+		}
+		relink(root)
+	}
+	return outline
+}
+
+// setAttr sets key on n and returns its previous value.
+func setAttr(n *html.Node, key, val string) string {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return a.Val
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+	return ""
+}
+
+// slugify lowercases text and joins its letters and digits with hyphens,
+// keeping non-Latin letters so headings in any language get readable IDs.
+func slugify(text string) string {
+	var b strings.Builder
+	pendingDash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if pendingDash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingDash = false
+			b.WriteRune(r)
+			if b.Len() >= 64 {
+				break
+			}
+			continue
+		}
+		pendingDash = true
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}
+
+// textStats is a single pass over article text: how many words and Chinese
+// or Japanese characters it has, the scripts its letters are written in, and
+// the opening words in lower case for stopword matching.
+type textStats struct {
+	words      int
+	ideographs int
+	scripts    map[string]int
+	sample     []string
+}
+
+// scriptTables are the scripts language detection tells apart. Han and kana
+// count as ideographs for word counting, since those languages do not put
+// spaces between words.
+var scriptTables = []struct {
+	name       string
+	table      *unicode.RangeTable
+	ideograph  bool
+	singleLang string
+}{
+	{"latin", unicode.Latin, false, ""},
+	{"han", unicode.Han, true, ""},
+	{"kana", unicode.Hiragana, true, ""},
+	{"kana", unicode.Katakana, true, ""},
+	{"hangul", unicode.Hangul, false, "ko"},
+	{"cyrillic", unicode.Cyrillic, false, ""},
+	{"greek", unicode.Greek, false, "el"},
+	{"arabic", unicode.Arabic, false, "ar"},
+	{"hebrew", unicode.Hebrew, false, "he"},
+	{"thai", unicode.Thai, false, "th"},
+	{"devanagari", unicode.Devanagari, false, "hi"},
+}
+
+func measureText(text string) textStats {
+	stats := textStats{scripts: make(map[string]int)}
+	var word strings.Builder
+	endWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		stats.words++
+		if len(stats.sample) < languageSampleWords {
+			stats.sample = append(stats.sample, word.String())
+		}
+		word.Reset()
+	}
+	for _, r := range text {
+		if r == '\'' || r == '’' {
+			// Apostrophes belong to the word around them, as in "don't".
+			if word.Len() > 0 {
+				word.WriteRune('\'')
+			}
+			continue
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			endWord()
+			continue
+		}
+		ideograph := false
+		for _, script := range scriptTables {
+			if unicode.Is(script.table, r) {
+				stats.scripts[script.name]++
+				ideograph = script.ideograph
+				break
+			}
+		}
+		if ideograph {
+			endWord()
+			stats.ideographs++
+			continue
+		}
+		word.WriteRune(unicode.ToLower(r))
+	}
+	endWord()
+	return stats
+}
+
+// language returns the ISO 639-1 code of the text's language, or "" when it
+// cannot be told with confidence. The script decides it where only one
+// language here uses that script; Latin text is matched against stopwords.
+func (t textStats) language() string {
+	total, best, bestScript := 0, 0, ""
+	for name, n := range t.scripts {
+		total += n
+		if n > best {
+			best, bestScript = n, name
+		}
+	}
+	if total == 0 || best*2 < total {
+		return ""
+	}
+
+	switch bestScript {
+	case "latin":
+		return t.latinLanguage()
+	case "han", "kana":
+		// Japanese mixes kanji with kana; Chinese text has no kana at all.
+		if t.scripts["kana"]*10 >= t.scripts["han"]+t.scripts["kana"] {
+			return "ja"
+		}
+		return "zh"
+	case "cyrillic":
+		for _, w := range t.sample {
+			if strings.ContainsAny(w, "іїєґ") {
+				return "uk"
+			}
+		}
+		return "ru"
+	}
+	for _, script := range scriptTables {
+		if script.name == bestScript {
+			return script.singleLang
+		}
+	}
+	return ""
+}
+
+// stopwords are frequent function words of the Latin-script languages that
+// detection distinguishes. Words shared between languages still count for
+// each; what matters is which list matches the most.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "that", "it", "was", "for", "with", "this", "are", "have", "not", "but", "you", "they", "which", "from", "be"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "den", "sich", "des", "auf", "ein", "eine", "auch", "dem", "wird", "sind", "für", "zu", "von"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "du", "que", "dans", "qui", "pas", "pour", "sur", "au", "avec", "ce", "sont", "il", "nous"},
+	"es": {"el", "los", "las", "del", "que", "y", "una", "por", "con", "para", "es", "su", "al", "lo", "como", "más", "pero", "sus", "se", "fue"},
+	"it": {"il", "di", "che", "della", "per", "non", "una", "sono", "gli", "nel", "alla", "anche", "come", "più", "dei", "delle", "è", "questo", "ha", "si"},
+	"pt": {"o", "os", "que", "não", "uma", "para", "com", "do", "da", "dos", "das", "em", "no", "na", "por", "mais", "como", "mas", "foi", "é"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "zijn", "voor", "met", "ook", "maar", "wordt", "bij", "als", "er", "naar"},
+	"sv": {"och", "att", "det", "som", "är", "en", "på", "för", "av", "med", "har", "inte", "till", "den", "om", "ett", "var", "jag", "men", "kan"},
+	"pl": {"i", "w", "nie", "się", "na", "jest", "że", "do", "to", "z", "jak", "ale", "po", "tak", "dla", "od", "są", "być", "przez", "czy"},
+}
+
+var stopwordLanguages = func() map[string][]string {
+	index := make(map[string][]string)
+	for lang, words := range stopwords {
+		for _, w := range words {
+			index[w] = append(index[w], lang)
+		}
+	}
+	return index
+}()
+
+func (t textStats) latinLanguage() string {
+	hits := make(map[string]int)
+	for _, w := range t.sample {
+		for _, lang := range stopwordLanguages[w] {
+			hits[lang]++
+		}
+	}
+	best, second, bestLang := 0, 0, ""
+	for lang, n := range hits {
+		switch {
+		case n > best || (n == best && lang < bestLang):
+			best, second, bestLang = n, best, lang
+		case n > second:
+			second = n
+		}
+	}
+	// Short or mixed-language text is left undetected rather than guessed.
+	if best < languageMinHits || float64(best) < float64(second)*1.3 {
+		return ""
+	}
+	return bestLang
+}
+
+// normalizeLanguageTag reduces a BCP 47 tag such as "en-US" to its primary
+// language subtag, or "" if it does not look like one.
+func normalizeLanguageTag(tag string) string {
+	primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	primary, _, _ = strings.Cut(primary, "_")
+	primary = strings.ToLower(primary)
+	if len(primary) < 2 || len(primary) > 3 {
+		return ""
+	}
+	for _, r := range primary {
+		if r < 'a' || r > 'z' {
+			return ""
+		}
+	}
+	return primary
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnnotateArticleOutline(t *testing.T) {
+	article := &readerResponse{
+		Content: `<h1>Intro</h1><p>See <a href="#setup" rel="nofollow noopener">setup</a>.</p>` +
+			`<h2 id="setup">Getting <em>set up</em></h2><h3>  </h3><h2>Intro</h2><h2>Intro 2</h2><h3>Über &amp; “Café”</h3>`,
+		TextContent: "Intro See setup. Getting set up Intro",
+	}
+	annotateArticle(article, "")
+
+	want := []outlineEntry{
+		{Level: 1, ID: "reader-intro", Text: "Intro"},
+		{Level: 2, ID: "reader-getting-set-up", Text: "Getting set up"},
+		{Level: 2, ID: "reader-intro-2", Text: "Intro"},
+		{Level: 2, ID: "reader-intro-2-2", Text: "Intro 2"},
+		{Level: 3, ID: "reader-über-café", Text: "Über & “Café”"},
+	}
+	if !reflect.DeepEqual(article.Outline, want) {
+		t.Fatalf("outline =\n%+v\nwant\n%+v", article.Outline, want)
+	}
+	for _, fragment := range []string{`<h1 id="reader-intro">`, `<a href="#reader-getting-set-up"`, `<h2 id="reader-getting-set-up">`, `<h3>  </h3>`} {
+		if !strings.Contains(article.Content, fragment) {
+			t.Errorf("content missing %q:\n%s", fragment, article.Content)
+		}
+	}
+}
+
+func TestAnnotateArticleReadingTime(t *testing.T) {
+	article := &readerResponse{TextContent: strings.Repeat("It's a word, another word. ", 115)}
+	annotateArticle(article, "")
+	if article.WordCount != 575 || article.ReadingMinutes != 3 {
+		t.Fatalf("words = %d minutes = %d, want 575 and 3", article.WordCount, article.ReadingMinutes)
+	}
+
+	article = &readerResponse{TextContent: strings.Repeat("吾輩は猫である。", 100)}
+	annotateArticle(article, "")
+	if article.WordCount != 700 || article.ReadingMinutes != 2 {
+		t.Fatalf("words = %d minutes = %d, want 700 and 2", article.WordCount, article.ReadingMinutes)
+	}
+
+	article = &readerResponse{}
+	annotateArticle(article, "")
+	if article.WordCount != 0 || article.ReadingMinutes != 0 {
+		t.Fatalf("empty article: words = %d minutes = %d", article.WordCount, article.ReadingMinutes)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		declared string
+		want     string
+	}{
+		{"english", "The quick brown fox jumps over the lazy dog. It was the best of times and it was the worst of times, but this is not the end of the story for the people who are in it.", "", "en"},
+		{"german", "Der schnelle braune Fuchs springt über den faulen Hund. Das ist nicht die erste Geschichte, die auch von dem Hund erzählt wird, und sie ist mit Sicherheit nicht die letzte.", "", "de"},
+		{"french", "Le renard brun rapide saute par-dessus le chien paresseux. Il est dans la forêt avec les autres animaux, et nous ne savons pas pour combien de temps il y restera sur le chemin.", "", "fr"},
+		{"spanish", "El rápido zorro marrón salta sobre el perro perezoso. Los animales del bosque se reunieron para ver que pasaba, pero el zorro fue más rápido que todos y se escondió con sus amigos.", "", "es"},
+		{"japanese", charsetFixtures[0].text, "", "ja"},
+		{"chinese", charsetFixtures[2].text, "", "zh"},
+		{"korean", charsetFixtures[3].text, "", "ko"},
+		{"russian", "Быстрая коричневая лиса прыгает через ленивую собаку.", "", "ru"},
+		{"ukrainian", "Швидка бура лисиця перестрибує через ледачого пса, і їй це подобається.", "", "uk"},
+		{"too short falls back to declared", "Hello world", "en-GB", "en"},
+		{"nothing to go on", "12345", "not a tag", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			article := &readerResponse{TextContent: tt.text}
+			annotateArticle(article, tt.declared)
+			if article.Language != tt.want {
+				t.Errorf("language = %q, want %q", article.Language, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	archiveSourcesEnv = "HN_ARCHIVE_SOURCES"
+	// defaultArchiveSources asks the Wayback Machine only. Template mirrors
+	// that take the article URL in their path or query can be appended, e.g.
+	// "mirror=https://cache.example/search?q=cache:{url}".
+	defaultArchiveSources = "wayback=https://archive.org/wayback/available"
+	archiveURLPlaceholder = "{url}"
+	archiveChainTimeout   = 30 * time.Second
+	archiveMaxLookupBytes = 64 << 10
+
+	// readerSourceOrigin is readerResponse.Source for articles read from the
+	// site itself; archived ones carry the name of their archiveSource.
+	readerSourceOrigin = "origin"
+)
+
+// archiveSource is one mirror in the fallback chain. A base containing
+// archiveURLPlaceholder is a template the escaped article URL is substituted
+// into; any other base is a Wayback-style availability API, queried with
+// ?url= for the closest snapshot.
+type archiveSource struct {
+	name string
+	base string
+}
+
+// parseArchiveSources reads a comma-separated list of name=base pairs, tried
+// in order. An empty spec means defaultArchiveSources and "none" disables the
+// fallback.
+func parseArchiveSources(spec string) ([]archiveSource, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "":
+		spec = defaultArchiveSources
+	case "none":
+		return nil, nil
+	}
+
+	var sources []archiveSource
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, base, ok := strings.Cut(pair, "=")
+		name, base = strings.TrimSpace(name), strings.TrimSpace(base)
+		if !ok || name == "" || base == "" {
+			return nil, fmt.Errorf("archive source %q must be name=url", pair)
+		}
+		if name == readerSourceOrigin || seen[name] {
+			return nil, fmt.Errorf("archive source name %q is reserved or repeated", name)
+		}
+		parsed, err := url.Parse(strings.ReplaceAll(base, archiveURLPlaceholder, "x"))
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("archive source %q has an invalid url", pair)
+		}
+		seen[name] = true
+		sources = append(sources, archiveSource{name: name, base: base})
+	}
+	return sources, nil
+}
+
+// needsArchive reports whether a direct extraction is worth retrying through
+// the archives: the site refused, lost or timed out on the article, or only
+// served the part in front of a paywall. Refusals of our own, such as a
+// blocked address, are final.
+func needsArchive(article *readerResponse, err error) bool {
+	if err == nil {
+		return article.Paywalled
+	}
+	var readerErr *readerError
+	if !errors.As(err, &readerErr) {
+		return false
+	}
+	switch readerErr.upstream {
+	case http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusForbidden, http.StatusNotFound,
+		http.StatusGone, http.StatusTooManyRequests, http.StatusUnavailableForLegalReasons:
+		return true
+	}
+	return readerErr.upstream >= 500 || readerErr.status == http.StatusGatewayTimeout
+}
+
+// extractFromArchives walks s.archives for a copy of target. direct and
+// directErr are the outcome of reading target itself: a paywalled article is
+// only replaced by a longer archived one and is kept when none is found.
+func (s *server) extractFromArchives(ctx context.Context, target *url.URL, direct *readerResponse, directErr error) (*readerResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, archiveChainTimeout)
+	defer cancel()
+
+	for _, source := range s.archives {
+		snapshot, err := s.locateArchived(ctx, source, target)
+		if err != nil {
+			log.Printf("archive lookup failed source=%s url=%s: %v", source.name, target.String(), err)
+			continue
+		}
+		article, err := s.extractArticleFrom(ctx, target, snapshot)
+		if err != nil {
+			log.Printf("archive extraction failed source=%s url=%s: %v", source.name, snapshot.String(), err)
+			continue
+		}
+		if direct != nil && article.Length <= direct.Length {
+			continue
+		}
+		article.Source = source.name
+		// Snapshots keep the publisher's paywall markup, but the copy itself
+		// is readable.
+		article.Paywalled = false
+		return article, nil
+	}
+
+	if direct != nil {
+		return direct, nil
+	}
+	var readerErr *readerError
+	if errors.As(directErr, &readerErr) {
+		return nil, &readerError{status: readerErr.status, message: readerErr.message + "; no archived copy was found", upstream: readerErr.upstream}
+	}
+	return nil, directErr
+}
+
+// locateArchived returns the URL of source's copy of target.
+func (s *server) locateArchived(ctx context.Context, source archiveSource, target *url.URL) (*url.URL, error) {
+	if strings.Contains(source.base, archiveURLPlaceholder) {
+		return url.Parse(strings.ReplaceAll(source.base, archiveURLPlaceholder, url.QueryEscape(target.String())))
+	}
+
+	lookup, err := url.Parse(source.base)
+	if err != nil {
+		return nil, err
+	}
+	query := lookup.Query()
+	query.Set("url", target.String())
+	lookup.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, readerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookup.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", readerUserAgent)
+
+	resp, err := s.readerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("availability lookup returned %d", resp.StatusCode)
+	}
+
+	var availability struct {
+		ArchivedSnapshots struct {
+			Closest *struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Status    string `json:"status"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, archiveMaxLookupBytes)).Decode(&availability); err != nil {
+		return nil, fmt.Errorf("decode availability: %w", err)
+	}
+	closest := availability.ArchivedSnapshots.Closest
+	if closest == nil || !closest.Available || closest.URL == "" || (closest.Status != "" && closest.Status != "200") {
+		return nil, errors.New("no snapshot available")
+	}
+	snapshot, err := url.Parse(waybackTimestamp.ReplaceAllString(closest.URL, "${1}id_/"))
+	if err != nil || (snapshot.Scheme != "http" && snapshot.Scheme != "https") {
+		return nil, fmt.Errorf("invalid snapshot url %q", closest.URL)
+	}
+	return snapshot, nil
+}
+
+// waybackTimestamp matches the timestamp segment of a Wayback snapshot URL.
+// Suffixing it with id_ asks for the page as archived, without the toolbar
+// and link rewriting.
+var waybackTimestamp = regexp.MustCompile(`^(.*?/web/\d{1,14})/`)
+
+// paywallMarker matches the schema.org isAccessibleForFree=false flag that
+// paywalled news sites publish, as JSON-LD or microdata.
+var paywallMarker = regexp.MustCompile(`(?i)["']?isAccessibleForFree["']?\s*(?::\s*["']?|content\s*=\s*["'])false\b`)
+
+func declaresPaywall(body []byte) bool {
+	return paywallMarker.Match(body)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseArchiveSources(t *testing.T) {
+	sources, err := parseArchiveSources("")
+	if err != nil || len(sources) != 1 || sources[0].name != "wayback" {
+		t.Fatalf("defaults = %+v, %v", sources, err)
+	}
+	if sources, err := parseArchiveSources("none"); err != nil || len(sources) != 0 {
+		t.Fatalf("none = %+v, %v", sources, err)
+	}
+	sources, err = parseArchiveSources(" mirror = https://mirror.example/{url} , wb=http://wb.example/available ")
+	if err != nil || len(sources) != 2 || sources[0] != (archiveSource{name: "mirror", base: "https://mirror.example/{url}"}) {
+		t.Fatalf("custom = %+v, %v", sources, err)
+	}
+	for _, bad := range []string{"wayback", "=https://a.example", "a=ftp://a.example", "a=https://a.example,a=https://b.example", "origin=https://a.example"} {
+		if _, err := parseArchiveSources(bad); err == nil {
+			t.Errorf("parseArchiveSources(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestNeedsArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		article *readerResponse
+		err     error
+		want    bool
+	}{
+		{"readable", &readerResponse{}, nil, false},
+		{"paywalled", &readerResponse{Paywalled: true}, nil, true},
+		{"upstream 403", nil, &readerError{status: http.StatusBadGateway, upstream: http.StatusForbidden}, true},
+		{"upstream 404", nil, &readerError{status: http.StatusBadGateway, upstream: http.StatusNotFound}, true},
+		{"upstream 503", nil, &readerError{status: http.StatusBadGateway, upstream: http.StatusServiceUnavailable}, true},
+		{"upstream 400", nil, &readerError{status: http.StatusBadGateway, upstream: http.StatusBadRequest}, false},
+		{"timeout", nil, &readerError{status: http.StatusGatewayTimeout}, true},
+		{"blocked address", nil, &readerError{status: http.StatusForbidden}, false},
+		{"not html", nil, &readerError{status: http.StatusUnsupportedMediaType}, false},
+		{"other error", nil, errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := needsArchive(tt.article, tt.err); got != tt.want {
+			t.Errorf("%s: needsArchive = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func articlePage(head string, paragraphs int, text string) string {
+	var b strings.Builder
+	b.WriteString("<!doctype html><html><head><title>Archived story</title>" + head + "</head><body><article><h1>Archived story</h1>")
+	for i := 0; i < paragraphs; i++ {
+		fmt.Fprintf(&b, "<p>%s Paragraph %d goes on about the subject at some length, with enough words and commas, so that it scores as content.</p>", text, i)
+	}
+	b.WriteString("</article></body></html>")
+	return b.String()
+}
+
+func TestExtractArticleFallsBackToArchives(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/paywalled":
+			w.Header().Set(contentTypeHeader, "text/html")
+			w.Write([]byte(articlePage(`<script type="application/ld+json">{"isAccessibleForFree": false}</script>`, 2, "Teaser.")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	snapshots := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/web/20240102030405id_/") {
+			t.Errorf("snapshot requested as %s, want the id_ form", r.URL.Path)
+		}
+		head := ""
+		if strings.HasSuffix(r.URL.Path, "/paywalled") {
+			head = `<script type="application/ld+json">{"isAccessibleForFree": false}</script>`
+		}
+		w.Header().Set(contentTypeHeader, "text/html")
+		w.Write([]byte(articlePage(head, 8, "From the wayback.")))
+	}))
+	defer snapshots.Close()
+
+	wayback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("url")
+		closest := map[string]any{"available": true, "status": "200", "url": snapshots.URL + "/web/20240102030405/" + target}
+		if strings.HasSuffix(target, "/only-cached") || strings.HasSuffix(target, "/lost") {
+			closest = map[string]any{"available": false}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"archived_snapshots": map[string]any{"closest": closest}})
+	}))
+	defer wayback.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Query().Get("q"), "/only-cached") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(contentTypeHeader, "text/html")
+		w.Write([]byte(articlePage("", 8, "From the mirror.")))
+	}))
+	defer mirror.Close()
+
+	archives, err := parseArchiveSources("wayback=" + wayback.URL + "/available,mirror=" + mirror.URL + "/cache?q={url}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{readerClient: newGuardedClient(func(netip.Addr) bool { return true }), archives: archives}
+	extract := func(path string) (*readerResponse, error) {
+		target, _ := url.Parse(origin.URL + path)
+		return s.extractArticle(context.Background(), target)
+	}
+
+	article, err := extract("/gone")
+	if err != nil {
+		t.Fatalf("wayback fallback: %v", err)
+	}
+	if article.Source != "wayback" || !strings.Contains(article.TextContent, "From the wayback.") || article.URL != origin.URL+"/gone" {
+		t.Errorf("wayback fallback = source %q url %q text %q", article.Source, article.URL, article.TextContent)
+	}
+
+	article, err = extract("/only-cached")
+	if err != nil || article.Source != "mirror" || !strings.Contains(article.TextContent, "From the mirror.") {
+		t.Errorf("mirror fallback = %+v, %v", article, err)
+	}
+
+	article, err = extract("/paywalled")
+	if err != nil || article.Source != "wayback" || article.Paywalled {
+		t.Errorf("paywall fallback = %+v, %v", article, err)
+	}
+
+	var readerErr *readerError
+	if _, err := extract("/lost"); !errors.As(err, &readerErr) || readerErr.status != http.StatusBadGateway || !strings.Contains(readerErr.message, "no archived copy") {
+		t.Errorf("exhausted chain error = %v, want a 502 saying no archived copy was found", err)
+	}
+
+	s.archives = nil
+	article, err = extract("/paywalled")
+	if err != nil || article.Source != readerSourceOrigin || !article.Paywalled {
+		t.Errorf("paywalled without archives = %+v, %v", article, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogs/chardet"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// charsetMinConfidence is the chardet confidence, out of 100, below which a
+// sniffed guess is ignored in favor of the HTML default of windows-1252.
+const charsetMinConfidence = 40
+
+// detectHTMLEncoding picks the encoding of an HTML document the way browsers
+// do: a byte order mark, then the Content-Type charset, then a <meta> charset
+// in the first kilobyte. Documents that declare nothing are taken as UTF-8 if
+// they validate as such and are otherwise sniffed with chardet before falling
+// back to windows-1252.
+func detectHTMLEncoding(body []byte, contentType string) (encoding.Encoding, string) {
+	enc, name, certain := charset.DetermineEncoding(body, contentType)
+	if certain || name != "windows-1252" {
+		return enc, name
+	}
+	// windows-1252 is both a legitimate declaration and DetermineEncoding's
+	// fallback when nothing was declared; only the latter is worth sniffing.
+	if declaresMetaCharset(body) {
+		return enc, name
+	}
+	if utf8.Valid(body) {
+		return encoding.Nop, "utf-8"
+	}
+
+	result, err := chardet.NewHtmlDetector().DetectBest(body)
+	if err == nil && result.Confidence >= charsetMinConfidence {
+		if sniffed, sniffedName := charset.Lookup(result.Charset); sniffed != nil {
+			return sniffed, sniffedName
+		}
+	}
+	return enc, name
+}
+
+// declaresMetaCharset reports whether the first kilobyte carries a <meta>
+// charset declaration with a label the encoding registry knows. Text that
+// merely mentions "charset", in a script say, does not count, and nor does
+// a label DetermineEncoding would have rejected.
+func declaresMetaCharset(body []byte) bool {
+	if len(body) > 1024 {
+		body = body[:1024]
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" || !hasAttr {
+				continue
+			}
+			var label, httpEquiv, content string
+			for more := true; more; {
+				var key, val []byte
+				key, val, more = z.TagAttr()
+				switch string(key) {
+				case "charset":
+					label = string(val)
+				case "http-equiv":
+					httpEquiv = strings.ToLower(string(val))
+				case "content":
+					content = string(val)
+				}
+			}
+			if label == "" && httpEquiv == "content-type" {
+				if _, params, err := mime.ParseMediaType(content); err == nil {
+					label = params["charset"]
+				}
+			}
+			if label == "" {
+				continue
+			}
+			if enc, _ := charset.Lookup(label); enc != nil {
+				return true
+			}
+		}
+	}
+}
+
+// parseHTMLDocument transcodes body to UTF-8 and parses it. Text is also
+// normalized to NFC with soft hyphens removed, matching what readability's
+// own parser does.
+func parseHTMLDocument(body []byte, contentType string) (*html.Node, string, error) {
+	enc, name := detectHTMLEncoding(body, contentType)
+	normalize := transform.Chain(
+		enc.NewDecoder(),
+		norm.NFD,
+		runes.Remove(runes.Predicate(func(r rune) bool { return r == '\u00AD' })),
+		norm.NFC,
+	)
+	doc, err := html.Parse(transform.NewReader(bytes.NewReader(body), normalize))
+	if err != nil {
+		return nil, "", err
+	}
+	return doc, strings.ToLower(name), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// charsetFixtures are article snippets long enough for chardet to identify
+// them when nothing declares the encoding.
+var charsetFixtures = []struct {
+	name    string
+	label   string
+	enc     encoding.Encoding
+	text    string
+	sniffed []string
+}{
+	{
+		name:    "shift_jis",
+		label:   "Shift_JIS",
+		enc:     japanese.ShiftJIS,
+		text:    "吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。何でも薄暗いじめじめした所でニャーニャー泣いていた事だけは記憶している。吾輩はここで始めて人間というものを見た。",
+		sniffed: []string{"shift_jis"},
+	},
+	{
+		name:    "windows-1252",
+		label:   "windows-1252",
+		enc:     charmap.Windows1252,
+		text:    "Le café était déjà fermé quand nous sommes arrivés à la gare. « Où est le garçon ? » demanda-t-elle, un peu inquiète, en regardant la façade ornée de l’hôtel.",
+		sniffed: []string{"windows-1252"},
+	},
+	{
+		name:    "gbk",
+		label:   "GBK",
+		enc:     simplifiedchinese.GBK,
+		text:    "北京是中华人民共和国的首都，也是全国的政治中心和文化中心。这座城市有着三千多年的建城史，拥有众多名胜古迹和现代化建筑，每年吸引大量的游客前来参观。",
+		sniffed: []string{"gbk", "gb18030"},
+	},
+	{
+		name:    "euc-kr",
+		label:   "EUC-KR",
+		enc:     korean.EUCKR,
+		text:    "대한민국의 수도는 서울특별시이며, 한반도의 중부에 위치하고 있다. 서울은 정치와 경제, 문화의 중심지로서 오랜 역사를 가지고 있으며 많은 사람들이 살고 있는 도시이다.",
+		sniffed: []string{"euc-kr"},
+	},
+}
+
+func encodeFixture(t *testing.T, enc encoding.Encoding, s string) []byte {
+	t.Helper()
+	encoded, err := enc.NewEncoder().String(s)
+	if err != nil {
+		t.Fatalf("encode fixture: %v", err)
+	}
+	return []byte(encoded)
+}
+
+func documentText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+func TestParseHTMLDocumentLegacyEncodings(t *testing.T) {
+	for _, fixture := range charsetFixtures {
+		body := encodeFixture(t, fixture.enc, fixture.text)
+		cases := []struct {
+			how         string
+			head        string
+			contentType string
+			want        []string
+		}{
+			{"header", "", "text/html; charset=" + fixture.label, nil},
+			{"meta", `<meta charset="` + fixture.label + `">`, "text/html", nil},
+			{"http-equiv", `<meta http-equiv="Content-Type" content="text/html; charset=` + fixture.label + `">`, "text/html", nil},
+			{"sniffed", "", "text/html", fixture.sniffed},
+		}
+		for _, tc := range cases {
+			t.Run(fixture.name+"/"+tc.how, func(t *testing.T) {
+				doc := append([]byte("<!doctype html><html><head>"+tc.head+"<title>t</title></head><body><p>"), body...)
+				doc = append(doc, "</p></body></html>"...)
+
+				root, name, err := parseHTMLDocument(doc, tc.contentType)
+				if err != nil {
+					t.Fatalf("parseHTMLDocument: %v", err)
+				}
+				if got := documentText(root); !strings.Contains(got, fixture.text) {
+					t.Fatalf("decoded text = %q, want it to contain %q", got, fixture.text)
+				}
+				want := tc.want
+				if want == nil {
+					_, canonical := charset.Lookup(fixture.label)
+					want = []string{strings.ToLower(canonical)}
+				}
+				found := false
+				for _, w := range want {
+					found = found || name == w
+				}
+				if !found {
+					t.Fatalf("charset = %q, want one of %q", name, want)
+				}
+			})
+		}
+	}
+}
+
+func TestDetectHTMLEncodingIgnoresStrayCharsetText(t *testing.T) {
+	fixture := charsetFixtures[0]
+	body := encodeFixture(t, fixture.enc, fixture.text)
+	heads := map[string]string{
+		"script":        `<script>var charset = "utf-8";</script>`,
+		"unknown label": `<meta charset="x-no-such-encoding">`,
+	}
+	for name, head := range heads {
+		t.Run(name, func(t *testing.T) {
+			doc := append([]byte("<html><head>"+head+"</head><body><p>"), body...)
+			if _, got := detectHTMLEncoding(doc, "text/html"); got != "shift_jis" {
+				t.Fatalf("detectHTMLEncoding = %q, want shift_jis", got)
+			}
+		})
+	}
+}
+
+func TestDetectHTMLEncodingDefaults(t *testing.T) {
+	if _, got := detectHTMLEncoding([]byte("<p>plain ascii</p>"), ""); got != "utf-8" {
+		t.Errorf("ASCII document detected as %q, want utf-8", got)
+	}
+	if _, got := detectHTMLEncoding([]byte("<p>caf\xc3\xa9</p>"), ""); got != "utf-8" {
+		t.Errorf("UTF-8 document detected as %q, want utf-8", got)
+	}
+	if _, got := detectHTMLEncoding([]byte("\xef\xbb\xbf<p>bom</p>"), "text/html; charset=iso-8859-2"); got != "utf-8" {
+		t.Errorf("BOM document detected as %q, want utf-8", got)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	diskCacheDirEnv      = "HN_CACHE_DIR"
+	diskCacheMaxBytes    = 256 << 20
+	diskCacheCompactEach = 10 * time.Minute
+	diskCacheFileSuffix  = ".json"
+	// diskCacheQueueLen is how many writes may wait for the writer before
+	// further ones are dropped.
+	diskCacheQueueLen = 1024
+)
+
+// diskCache is the optional persistent tier behind ttlLRUCache. Each entry is
+// a small JSON file named after the hash of its cache key; the file mtime is
+// set to the hard expiry so compaction only needs to stat the tree. Stores and
+// deletes are applied in order by a single writer goroutine, off the request
+// path.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+	ops      chan diskOp
+}
+
+// diskOp is one queued change to the tree. A nil value deletes key, and an
+// op with done set only marks a point in the queue for Flush.
+type diskOp struct {
+	key       string
+	value     any
+	staleAt   time.Time
+	expiresAt time.Time
+	done      chan struct{}
+}
+
+type diskRecord struct {
+	Key       string          `json:"key"`
+	Kind      string          `json:"kind"`
+	StaleAt   time.Time       `json:"stale_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, maxBytes: maxBytes, ops: make(chan diskOp, diskCacheQueueLen)}
+	go d.run()
+	return d, nil
+}
+
+func (d *diskCache) run() {
+	for op := range d.ops {
+		switch {
+		case op.done != nil:
+			close(op.done)
+		case op.value == nil:
+			d.remove(op.key)
+		default:
+			d.write(op.key, op.value, op.staleAt, op.expiresAt)
+		}
+	}
+}
+
+// Flush waits until every Store and Delete queued before it has been applied.
+func (d *diskCache) Flush() {
+	done := make(chan struct{})
+	d.ops <- diskOp{done: done}
+	<-done
+}
+
+func (d *diskCache) pathFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name+diskCacheFileSuffix)
+}
+
+// Load returns the persisted value for key if it has not passed its hard
+// expiry. Expired or unreadable files are removed.
+func (d *diskCache) Load(key string) (value any, staleAt time.Time, expiresAt time.Time, ok bool) {
+	path := d.pathFor(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("disk cache read failed key=%s: %v", key, err)
+		}
+		return nil, time.Time{}, time.Time{}, false
+	}
+
+	var record diskRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.Key != key {
+		_ = os.Remove(path)
+		return nil, time.Time{}, time.Time{}, false
+	}
+	if time.Now().After(record.ExpiresAt) {
+		_ = os.Remove(path)
+		return nil, time.Time{}, time.Time{}, false
+	}
+
+	value, ok = decodeCacheValue(record.Kind, record.Value)
+	if !ok {
+		_ = os.Remove(path)
+		return nil, time.Time{}, time.Time{}, false
+	}
+	return value, record.StaleAt, record.ExpiresAt, true
+}
+
+// Store queues value to be persisted if its type has a disk encoding; other
+// values stay memory-only. When the writer is too far behind the value is
+// only kept in memory. Cached values are never modified, so the writer can
+// encode them later.
+func (d *diskCache) Store(key string, value any, staleAt time.Time, expiresAt time.Time) {
+	if value == nil {
+		return
+	}
+	select {
+	case d.ops <- diskOp{key: key, value: value, staleAt: staleAt, expiresAt: expiresAt}:
+	default:
+		log.Printf("disk cache write dropped key=%s: queue full", key)
+	}
+}
+
+func (d *diskCache) write(key string, value any, staleAt time.Time, expiresAt time.Time) {
+	kind, raw, ok := encodeCacheValue(value)
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(diskRecord{
+		Key:       key,
+		Kind:      kind,
+		StaleAt:   staleAt,
+		ExpiresAt: expiresAt,
+		Value:     raw,
+	})
+	if err != nil {
+		log.Printf("disk cache encode failed key=%s: %v", key, err)
+		return
+	}
+
+	path := d.pathFor(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("disk cache mkdir failed key=%s: %v", key, err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		log.Printf("disk cache write failed key=%s: %v", key, err)
+		return
+	}
+	_, writeErr := tmp.Write(data)
+	closeErr := tmp.Close()
+	if writeErr != nil || closeErr != nil {
+		_ = os.Remove(tmp.Name())
+		log.Printf("disk cache write failed key=%s: %v", key, errors.Join(writeErr, closeErr))
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		log.Printf("disk cache rename failed key=%s: %v", key, err)
+		return
+	}
+	// Compaction reads the expiry from the mtime; an entry without it would
+	// look freshly written and outlive the ones that should go first.
+	if err := os.Chtimes(path, expiresAt, expiresAt); err != nil {
+		log.Printf("disk cache chtimes failed key=%s: %v", key, err)
+		d.remove(key)
+	}
+}
+
+// Delete removes the persisted entry for key, if any, once the writes queued
+// before it have been applied. Unlike Store it waits for room in the queue,
+// so that a pending write cannot outlive the delete.
+func (d *diskCache) Delete(key string) {
+	d.ops <- diskOp{key: key}
+}
+
+func (d *diskCache) remove(key string) {
+	if err := os.Remove(d.pathFor(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("disk cache delete failed key=%s: %v", key, err)
+	}
+}
+
+func (d *diskCache) StartCompactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		d.Compact()
+		for range ticker.C {
+			d.Compact()
+		}
+	}()
+}
+
+// Compact removes expired entries and, if the tree is still over maxBytes,
+// the entries closest to expiry until it fits.
+func (d *diskCache) Compact() {
+	type diskFile struct {
+		path      string
+		size      int64
+		expiresAt time.Time
+	}
+
+	now := time.Now()
+	var (
+		files   []diskFile
+		total   int64
+		removed int
+	)
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if filepath.Ext(path) != diskCacheFileSuffix {
+			// Temp files from an interrupted Store are only swept once abandoned.
+			if now.Sub(info.ModTime()) > time.Hour {
+				_ = os.Remove(path)
+			}
+			return nil
+		}
+		if now.After(info.ModTime()) {
+			if os.Remove(path) == nil {
+				removed++
+			}
+			return nil
+		}
+		files = append(files, diskFile{path: path, size: info.Size(), expiresAt: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Printf("disk cache compaction failed: %v", err)
+		return
+	}
+
+	if d.maxBytes > 0 && total > d.maxBytes {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].expiresAt.Before(files[j].expiresAt)
+		})
+		for _, file := range files {
+			if total <= d.maxBytes {
+				break
+			}
+			if os.Remove(file.path) == nil {
+				total -= file.size
+				removed++
+			}
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("disk cache compaction removed %d entries", removed)
+	}
+}
+
+func encodeCacheValue(value any) (string, json.RawMessage, bool) {
+	var kind string
+	switch value.(type) {
+	case *hnItem:
+		// Items are stored with their text already sanitized. Entries of the
+		// older "item" kind predate that and are discarded on load.
+		kind = "clean_item"
+	case nilItemMarker:
+		return "nil_item", nil, true
+	case []int:
+		kind = "ids"
+	case *readerResponse:
+		kind = "reader"
+	case *previewResponse:
+		kind = "preview"
+	default:
+		return "", nil, false
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, false
+	}
+	return kind, raw, true
+}
+
+func decodeCacheValue(kind string, raw json.RawMessage) (any, bool) {
+	switch kind {
+	case "clean_item":
+		var item hnItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, false
+		}
+		return &item, true
+	case "nil_item":
+		return nilItemMarker{}, true
+	case "ids":
+		var ids []int
+		if err := json.Unmarshal(raw, &ids); err != nil {
+			return nil, false
+		}
+		if ids == nil {
+			ids = []int{}
+		}
+		return ids, true
+	case "reader":
+		var article readerResponse
+		if err := json.Unmarshal(raw, &article); err != nil {
+			return nil, false
+		}
+		return &article, true
+	case "preview":
+		var preview previewResponse
+		if err := json.Unmarshal(raw, &preview); err != nil {
+			return nil, false
+		}
+		return &preview, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheRoundTrip(t *testing.T) {
+	disk, err := newDiskCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	item := &hnItem{ID: 7, Type: "story", Title: "Stored", Kids: []int{8, 9}}
+	disk.Store("item:7", item, now.Add(time.Minute), now.Add(time.Hour))
+	disk.Store("item:8", nilItemMarker{}, now.Add(time.Minute), now.Add(time.Hour))
+	disk.Store("ids:top", []int{}, now.Add(time.Minute), now.Add(time.Hour))
+	disk.Store("user:x", &hnUser{ID: "x"}, now.Add(time.Minute), now.Add(time.Hour))
+	disk.Flush()
+
+	value, staleAt, expiresAt, ok := disk.Load("item:7")
+	if !ok || !reflect.DeepEqual(value, item) || !staleAt.Equal(now.Add(time.Minute)) || !expiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("item = %+v stale %v expires %v ok %v", value, staleAt, expiresAt, ok)
+	}
+	if info, err := os.Stat(disk.pathFor("item:7")); err != nil || !info.ModTime().Equal(now.Add(time.Hour)) {
+		t.Fatalf("mtime = %v, %v, want the expiry", info.ModTime(), err)
+	}
+	if value, _, _, ok := disk.Load("item:8"); !ok || value != (nilItemMarker{}) {
+		t.Errorf("nil item = %v, %v", value, ok)
+	}
+	if value, _, _, ok := disk.Load("ids:top"); !ok || !reflect.DeepEqual(value, []int{}) {
+		t.Errorf("empty ids = %#v, %v", value, ok)
+	}
+	if _, _, _, ok := disk.Load("user:x"); ok {
+		t.Error("a value without a disk encoding was persisted")
+	}
+
+	disk.Store("item:9", item, now.Add(time.Minute), now.Add(time.Hour))
+	disk.Delete("item:9")
+	disk.Flush()
+	if _, _, _, ok := disk.Load("item:9"); ok {
+		t.Error("entry stored and then deleted is still on disk")
+	}
+}
+
+func TestDiskCacheExpiry(t *testing.T) {
+	disk, err := newDiskCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.Store("item:1", &hnItem{ID: 1}, time.Now().Add(-2*time.Minute), time.Now().Add(-time.Minute))
+	disk.Flush()
+	if _, _, _, ok := disk.Load("item:1"); ok {
+		t.Fatal("expired entry was loaded")
+	}
+	if _, err := os.Stat(disk.pathFor("item:1")); !os.IsNotExist(err) {
+		t.Fatalf("expired file left behind: %v", err)
+	}
+
+	path := disk.pathFor("item:2")
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	os.WriteFile(path, []byte("not json"), 0o644)
+	if _, _, _, ok := disk.Load("item:2"); ok {
+		t.Fatal("corrupt entry was loaded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("corrupt file left behind: %v", err)
+	}
+}
+
+func TestDiskCacheCompact(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := newDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, expiry := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		disk.Store("ids:"+string(rune('a'+i)), []int{1, 2, 3}, now, now.Add(expiry))
+	}
+	disk.Flush()
+	info, err := os.Stat(disk.pathFor("ids:a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := disk.pathFor("ids:gone")
+	os.MkdirAll(filepath.Dir(expired), 0o755)
+	os.WriteFile(expired, []byte("{}"), 0o644)
+	os.Chtimes(expired, now.Add(-time.Minute), now.Add(-time.Minute))
+	abandoned := filepath.Join(dir, ".tmp-abandoned")
+	os.WriteFile(abandoned, nil, 0o644)
+	os.Chtimes(abandoned, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+
+	// Room for two entries: the one closest to expiry goes.
+	disk.maxBytes = 2 * info.Size()
+	disk.Compact()
+	for key, want := range map[string]bool{"ids:a": true, "ids:b": false, "ids:c": true} {
+		if _, err := os.Stat(disk.pathFor(key)); (err == nil) != want {
+			t.Errorf("%s kept = %v, want %v", key, err == nil, want)
+		}
+	}
+	for _, path := range []string{expired, abandoned} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s survived compaction", filepath.Base(path))
+		}
+	}
+}
+
+func TestCacheFallsBackToDisk(t *testing.T) {
+	disk, err := newDiskCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := newTTLRUCache(8)
+	first.disk = disk
+	first.SetWithGrace("item:1", &hnItem{ID: 1, Title: "Persisted"}, time.Minute, time.Minute)
+	disk.Flush()
+
+	second := newTTLRUCache(8)
+	second.disk = disk
+	value, ok := second.Get("item:1")
+	if item, _ := value.(*hnItem); !ok || item.Title != "Persisted" {
+		t.Fatalf("restarted cache = %+v, %v", value, ok)
+	}
+	if stats := second.Stats(); stats.DiskHits != 1 {
+		t.Fatalf("disk hits = %d, want 1", stats.DiskHits)
+	}
+}
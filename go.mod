@@ -1,5 +1,17 @@
 module hn-fork
 
-go 1.22
+go 1.23
 
-require github.com/go-shiori/go-readability v0.0.0-20251205110129-5db1dc9836f0
+require (
+	github.com/go-shiori/go-readability v0.0.0-20251205110129-5db1dc9836f0
+	github.com/gogs/chardet v0.0.0-20211120154057-b7413eaefb8f
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.35.0
+	golang.org/x/text v0.22.0
+)
+
+require (
+	github.com/andybalholm/cascadia v1.3.3 // indirect
+	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de // indirect
+	github.com/go-shiori/dom v0.0.0-20230515143342-73569d674e1c // indirect
+)
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	imageProxyPath = "/api/image"
+	imageMaxBytes  = 8_000_000
+	imageMaxPixels = 40_000_000
+	// imageMaxDecodes bounds the resizes in flight, each of which may hold a
+	// decoded imageMaxPixels image and its scaled copy in memory.
+	imageMaxDecodes    = 2
+	imageMaxWidth      = 1200
+	imageMinWidth      = 16
+	imageJPEGQuality   = 82
+	imageCacheEntries  = 512
+	imageCacheMaxBytes = 64 << 20
+	imageCacheTTL      = 24 * time.Hour
+	imageFailureTTL    = 2 * time.Minute
+	imageBrowserMaxAge = 30 * 24 * time.Hour
+	imageAccept        = "image/webp,image/png,image/jpeg,image/gif,image/avif,image/*;q=0.8"
+)
+
+// imageTypes are the formats the proxy serves, keyed by sniffed media type.
+// Only the resizable ones are decoded; the rest pass through untouched. SVG
+// is deliberately absent because it can carry script.
+var imageTypes = map[string]bool{
+	"image/jpeg":   true,
+	"image/png":    true,
+	"image/webp":   true,
+	"image/gif":    false,
+	"image/avif":   false,
+	"image/x-icon": false,
+}
+
+// imageDecodeSlots is the semaphore behind imageMaxDecodes, shared by every
+// request.
+var imageDecodeSlots = make(chan struct{}, imageMaxDecodes)
+
+// proxiedImage is an image ready to be served by the proxy.
+type proxiedImage struct {
+	contentType string
+	body        []byte
+}
+
+// imageCacheSize is the sizeOf for the image cache.
+func imageCacheSize(value any) int64 {
+	if img, ok := value.(*proxiedImage); ok {
+		return int64(len(img.body)) + 64
+	}
+	return 64
+}
+
+// proxiedImageURL returns a rewriter from image references in an article at
+// base to proxy URLs, or "" for references that cannot be proxied.
+func proxiedImageURL(base *url.URL) func(string) string {
+	return func(src string) string {
+		ref, err := url.Parse(src)
+		if err != nil {
+			return ""
+		}
+		resolved := base.ResolveReference(ref)
+		if resolved.Scheme != "http" && resolved.Scheme != "https" {
+			return ""
+		}
+		return imageProxyPath + "?url=" + url.QueryEscape(resolved.String())
+	}
+}
+
+// originalImageURL undoes proxiedImageURL, for renderings that are read
+// away from this server. Other URLs are returned unchanged.
+func originalImageURL(src string) string {
+	rest, ok := strings.CutPrefix(src, imageProxyPath+"?")
+	if !ok {
+		return src
+	}
+	query, err := url.ParseQuery(rest)
+	if err != nil || query.Get("url") == "" {
+		return src
+	}
+	return query.Get("url")
+}
+
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	target, problem := parseExternalURL(r.URL.Query().Get("url"))
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	width := imageMaxWidth
+	if raw := strings.TrimSpace(r.URL.Query().Get("w")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < imageMinWidth || parsed > imageMaxWidth {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("w must be between %d and %d", imageMinWidth, imageMaxWidth))
+			return
+		}
+		width = parsed
+	}
+
+	img, err := s.fetchImage(r.Context(), target, width)
+	if err != nil {
+		var readerErr *readerError
+		if errors.As(err, &readerErr) {
+			writeError(w, readerErr.status, readerErr.message)
+			return
+		}
+		log.Printf("image fetch failed url=%s: %v", target.String(), err)
+		writeError(w, http.StatusBadGateway, "failed to fetch image")
+		return
+	}
+
+	// The upstream bytes are only ever served as the sniffed image type, and
+	// never interpreted as a document even if opened directly.
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(imageBrowserMaxAge.Seconds())))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	writeBodyConditional(w, r, http.StatusOK, img.contentType, img.body)
+}
+
+// fetchImage returns target scaled down to at most width pixels wide.
+// Results and failures are cached in s.images.
+func (s *server) fetchImage(ctx context.Context, target *url.URL, width int) (*proxiedImage, error) {
+	cacheKey := "image:" + strconv.Itoa(width) + ":" + normalizeReaderURL(target)
+	if cached, ok := s.images.Get(cacheKey); ok {
+		switch v := cached.(type) {
+		case *proxiedImage:
+			return v, nil
+		case *readerError:
+			return nil, v
+		}
+	}
+
+	result, err := s.flights.Do(ctx, cacheKey, func(ctx context.Context) (any, error) {
+		img, err := s.loadImage(ctx, target, width)
+		if err != nil {
+			var readerErr *readerError
+			if errors.As(err, &readerErr) {
+				s.images.Set(cacheKey, readerErr, imageFailureTTL)
+			}
+			return nil, err
+		}
+		s.images.Set(cacheKey, img, imageCacheTTL)
+		return img, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	img, _ := result.(*proxiedImage)
+	return img, nil
+}
+
+func (s *server) loadImage(ctx context.Context, target *url.URL, width int) (*proxiedImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, readerTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, &readerError{status: http.StatusBadRequest, message: "invalid request URL"}
+	}
+	req.Header.Set("Accept", imageAccept)
+	req.Header.Set("User-Agent", readerUserAgent)
+
+	resp, err := s.readerClient.Do(req)
+	if err != nil {
+		return nil, guardedFetchError(ctx, target, err, "failed to fetch image")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > 299 {
+		return nil, &readerError{status: http.StatusBadGateway, message: fmt.Sprintf("upstream request failed (%d)", resp.StatusCode)}
+	}
+	declared := strings.ToLower(resp.Header.Get(contentTypeHeader))
+	if declared != "" && !strings.HasPrefix(declared, "image/") && !strings.HasPrefix(declared, "application/octet-stream") {
+		return nil, &readerError{status: http.StatusUnsupportedMediaType, message: "URL did not return an image"}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, imageMaxBytes+1))
+	if err != nil {
+		log.Printf("image body read failed url=%s: %v", target.String(), err)
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to fetch image"}
+	}
+	if len(data) > imageMaxBytes {
+		return nil, &readerError{status: http.StatusBadGateway, message: fmt.Sprintf("image is larger than %d MB", imageMaxBytes/1_000_000)}
+	}
+
+	contentType := sniffImageType(data)
+	resizable, ok := imageTypes[contentType]
+	if !ok {
+		return nil, &readerError{status: http.StatusUnsupportedMediaType, message: "URL did not return a supported image"}
+	}
+	original := &proxiedImage{contentType: contentType, body: data}
+	if !resizable {
+		return original, nil
+	}
+	return resizeImage(ctx, original, width)
+}
+
+// sniffImageType identifies data by its signature rather than trusting the
+// upstream Content-Type. AVIF is recognized here because the standard
+// sniffer does not know it.
+func sniffImageType(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		if brand := string(data[8:12]); brand == "avif" || brand == "avis" {
+			return "image/avif"
+		}
+	}
+	return http.DetectContentType(data)
+}
+
+// resizeImage scales img down to width, keeping its aspect ratio. Images that
+// are already narrow enough, or that would not get smaller by re-encoding,
+// are returned unchanged. WebP is re-encoded as JPEG, or PNG when it has
+// transparency, since there is no WebP encoder at hand. Images are measured
+// before they are decoded, and decoding waits for one of imageDecodeSlots.
+func resizeImage(ctx context.Context, img *proxiedImage, width int) (*proxiedImage, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.body))
+	if err != nil {
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to decode image"}
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > imageMaxPixels {
+		return nil, &readerError{status: http.StatusUnprocessableEntity, message: "image dimensions are too large"}
+	}
+	if config.Width <= width {
+		return img, nil
+	}
+
+	select {
+	case imageDecodeSlots <- struct{}{}:
+		defer func() { <-imageDecodeSlots }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for a decode slot: %w", ctx.Err())
+	}
+	src, _, err := image.Decode(bytes.NewReader(img.body))
+	if err != nil {
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to decode image"}
+	}
+	height := max(1, config.Height*width/config.Width)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var encoded bytes.Buffer
+	contentType := img.contentType
+	if contentType == "image/png" || (contentType == "image/webp" && !dst.Opaque()) {
+		contentType = "image/png"
+		err = png.Encode(&encoded, dst)
+	} else {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&encoded, dst, &jpeg.Options{Quality: imageJPEGQuality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode resized image: %w", err)
+	}
+	if encoded.Len() >= len(img.body) {
+		return img, nil
+	}
+	return &proxiedImage{contentType: contentType, body: encoded.Bytes()}, nil
+}
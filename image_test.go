@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxiedImageURLRoundTrip(t *testing.T) {
+	base, _ := url.Parse("https://example.com/posts/a.html")
+	rewrite := proxiedImageURL(base)
+
+	got := rewrite("../img/photo.jpg?size=large&v=2")
+	if want := "/api/image?url=https%3A%2F%2Fexample.com%2Fimg%2Fphoto.jpg%3Fsize%3Dlarge%26v%3D2"; got != want {
+		t.Fatalf("proxied = %q, want %q", got, want)
+	}
+	if original := originalImageURL(got); original != "https://example.com/img/photo.jpg?size=large&v=2" {
+		t.Fatalf("original = %q", original)
+	}
+	if got := rewrite("ftp://example.com/a.png"); got != "" {
+		t.Fatalf("ftp image proxied as %q, want it dropped", got)
+	}
+	if got := originalImageURL("https://cdn.example.com/a.png"); got != "https://cdn.example.com/a.png" {
+		t.Fatalf("unproxied URL changed to %q", got)
+	}
+}
+
+func TestSniffImageType(t *testing.T) {
+	tests := map[string]string{
+		"\x89PNG\r\n\x1a\n0000":            "image/png",
+		"\xff\xd8\xff\xe0":                 "image/jpeg",
+		"GIF89a....":                       "image/gif",
+		"RIFF\x00\x00\x00\x00WEBPVP8 ":     "image/webp",
+		"\x00\x00\x00\x1cftypavif\x00\x00": "image/avif",
+	}
+	for data, want := range tests {
+		if got := sniffImageType([]byte(data)); got != want {
+			t.Errorf("sniffImageType(%q) = %q, want %q", data, got, want)
+		}
+	}
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`)
+	if _, ok := imageTypes[sniffImageType(svg)]; ok {
+		t.Error("SVG must not be servable")
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2400, 600))
+	for x := 0; x < 2400; x++ {
+		src.Set(x, x%600, color.RGBA{R: uint8(x), A: 255})
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, src); err != nil {
+		t.Fatal(err)
+	}
+
+	resized, err := resizeImage(context.Background(), &proxiedImage{contentType: "image/png", body: encoded.Bytes()}, 600)
+	if err != nil {
+		t.Fatalf("resizeImage: %v", err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(resized.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || config.Width != 600 || config.Height != 150 {
+		t.Fatalf("resized to %s %dx%d, want png 600x150", format, config.Width, config.Height)
+	}
+
+	small := &proxiedImage{contentType: "image/png", body: encoded.Bytes()}
+	if same, _ := resizeImage(context.Background(), small, imageMaxWidth*2); same != small {
+		t.Fatal("image narrower than the limit was re-encoded")
+	}
+}
+
+// pngHeader is the start of a PNG declaring width by height pixels, enough
+// for image.DecodeConfig but not for image.Decode.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestResizeImageLimits(t *testing.T) {
+	// An image over the pixel cap is refused from its header; decoding this
+	// one would fail with a 502 instead.
+	huge := &proxiedImage{contentType: "image/png", body: pngHeader(10_000, 5_000)}
+	var readerErr *readerError
+	if _, err := resizeImage(context.Background(), huge, 600); !errors.As(err, &readerErr) || readerErr.status != http.StatusUnprocessableEntity {
+		t.Fatalf("oversized image error = %v, want a 422", err)
+	}
+
+	for i := 0; i < imageMaxDecodes; i++ {
+		imageDecodeSlots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < imageMaxDecodes; i++ {
+			<-imageDecodeSlots
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wide := &proxiedImage{contentType: "image/png", body: pngHeader(2_000, 100)}
+	if _, err := resizeImage(ctx, wide, 600); !errors.Is(err, context.Canceled) {
+		t.Fatalf("error with every decode slot taken = %v, want to give up waiting", err)
+	}
+}
+
+func TestHandleImageRefusesInternalHosts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("proxy connected to a loopback server")
+	}))
+	defer upstream.Close()
+
+	s := &server{
+		readerClient: newGuardedClient(isPublicAddr),
+		images:       newSizedTTLRUCache(8, 1<<20, imageCacheSize),
+		flights:      newFlightGroup(),
+	}
+	rec := httptest.NewRecorder()
+	s.handleImage(rec, httptest.NewRequest(http.MethodGet, "/api/image?url="+url.QueryEscape(upstream.URL+"/a.png"), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleImage(rec, httptest.NewRequest(http.MethodGet, "/api/image?url=https%3A%2F%2Fexample.com%2Fa.png&w=5", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("w=5 status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	updatesPollInterval  = 30 * time.Second
+	updatesCacheTTL      = 5 * time.Second
+	updatesRefreshBudget = 25 * time.Second
+	updatesCacheKey      = "updates"
+)
+
+// updatesWatcher keeps cached items and profiles in step with Firebase's
+// updates.json so they can carry long TTLs. Changed keys that are resident
+// in memory are refetched; anything else is dropped so the next read goes
+// upstream.
+type updatesWatcher struct {
+	s *server
+
+	polls     atomic.Int64
+	refreshed atomic.Int64
+	evicted   atomic.Int64
+	failures  atomic.Int64
+
+	// Only touched from the watcher goroutine.
+	lastItems    map[int]bool
+	lastProfiles map[string]bool
+}
+
+type updatesStats struct {
+	Polls     int64 `json:"polls"`
+	Refreshed int64 `json:"refreshed"`
+	Evicted   int64 `json:"evicted"`
+	Failures  int64 `json:"failures"`
+}
+
+func newUpdatesWatcher(s *server) *updatesWatcher {
+	return &updatesWatcher{s: s}
+}
+
+func (u *updatesWatcher) Stats() updatesStats {
+	return updatesStats{
+		Polls:     u.polls.Load(),
+		Refreshed: u.refreshed.Load(),
+		Evicted:   u.evicted.Load(),
+		Failures:  u.failures.Load(),
+	}
+}
+
+// fetchUpdates returns updates.json, shared briefly between the invalidation
+// watcher and the event stream poller so they cost one upstream request.
+func (s *server) fetchUpdates(ctx context.Context) (*firebaseUpdates, error) {
+	if cached, ok := s.cache.Get(updatesCacheKey); ok {
+		if updates, ok := cached.(*firebaseUpdates); ok {
+			return updates, nil
+		}
+	}
+
+	result, err := s.flights.Do(ctx, updatesCacheKey, func(ctx context.Context) (any, error) {
+		var updates firebaseUpdates
+		if err := s.fetchFirebaseJSON(ctx, "updates.json", &updates); err != nil {
+			return nil, err
+		}
+		s.cache.Set(updatesCacheKey, &updates, updatesCacheTTL)
+		return &updates, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	updates, _ := result.(*firebaseUpdates)
+	return updates, nil
+}
+
+func (u *updatesWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(updatesPollInterval)
+	defer ticker.Stop()
+	for {
+		u.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll applies one updates.json snapshot. The list is a rolling window, so
+// IDs already seen on the previous poll were handled then and are skipped.
+func (u *updatesWatcher) poll(ctx context.Context) {
+	pollCtx, cancel := context.WithTimeout(ctx, updatesRefreshBudget)
+	defer cancel()
+
+	updates, err := u.s.fetchUpdates(pollCtx)
+	if err != nil {
+		u.failures.Add(1)
+		log.Printf("updates poll failed: %v", err)
+		return
+	}
+	u.polls.Add(1)
+
+	firstPoll := u.lastItems == nil
+	items := make(map[int]bool, len(updates.Items))
+	profiles := make(map[string]bool, len(updates.Profiles))
+	var changedItems []int
+	var changedProfiles []string
+	for _, id := range updates.Items {
+		items[id] = true
+		if !u.lastItems[id] {
+			changedItems = append(changedItems, id)
+		}
+	}
+	for _, name := range updates.Profiles {
+		profiles[name] = true
+		if !u.lastProfiles[name] {
+			changedProfiles = append(changedProfiles, name)
+		}
+	}
+	u.lastItems = items
+	u.lastProfiles = profiles
+	if firstPoll {
+		// Entries loaded before the watcher started may predate any of these
+		// changes, so the first snapshot is applied in full.
+		changedItems = updates.Items
+		changedProfiles = updates.Profiles
+	}
+
+	sem := make(chan struct{}, maxConcurrentFetch)
+	var wg sync.WaitGroup
+	invalidate := func(cacheKey string, reload func(context.Context) error) {
+		if !u.s.cache.Contains(cacheKey) {
+			// Not worth a fetch, but a disk copy must not outlive the change.
+			u.s.cache.Delete(cacheKey)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-pollCtx.Done():
+				u.s.cache.Delete(cacheKey)
+				u.evicted.Add(1)
+				return
+			}
+			defer func() { <-sem }()
+
+			if err := reload(pollCtx); err != nil {
+				log.Printf("updates refresh failed key=%s: %v", cacheKey, err)
+				u.s.cache.Delete(cacheKey)
+				u.evicted.Add(1)
+				return
+			}
+			u.refreshed.Add(1)
+		}()
+	}
+
+	for _, id := range changedItems {
+		id := id
+		invalidate(fmt.Sprintf("item:%d", id), func(ctx context.Context) error {
+			_, err := u.s.loadItem(ctx, id)
+			return err
+		})
+	}
+	for _, name := range changedProfiles {
+		name := name
+		if _, ok := parseUsername(name); !ok {
+			continue
+		}
+		invalidate("user:"+name, func(ctx context.Context) error {
+			_, err := u.s.loadUser(ctx, name)
+			return err
+		})
+	}
+	wg.Wait()
+}
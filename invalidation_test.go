@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestUpdatesWatcherPoll(t *testing.T) {
+	s, fb := newFakeFirebaseServer(t, threadFixture()...)
+	fb.setDoc("user/op.json", hnUser{ID: "op", Karma: 10})
+	fb.setDoc("user/alice.json", hnUser{ID: "alice", Karma: 20})
+	ctx := context.Background()
+	for _, id := range []int{1, 20, 30} {
+		if _, err := s.loadItem(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"op", "alice"} {
+		if _, err := s.loadUser(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything changes upstream, but updates.json reports only some of it.
+	story := *threadFixture()[0]
+	story.Title = "Story, edited"
+	fb.setItem(&story)
+	fb.setItem(&hnItem{ID: 20, Type: "comment", Parent: 1, By: "bob", Text: "edited"})
+	fb.setDoc("user/op.json", hnUser{ID: "op", Karma: 11})
+	fb.setDoc("user/alice.json", hnUser{ID: "alice", Karma: 21})
+	fb.setFailing(30, true)
+	fb.setDoc("updates.json", firebaseUpdates{Items: []int{1, 30, 31}, Profiles: []string{"op", "not a name"}})
+
+	u := newUpdatesWatcher(s)
+	u.poll(ctx)
+
+	cachedItem := func(id int) *hnItem {
+		item, _ := s.cache.Peek(fmt.Sprintf("item:%d", id)).(*hnItem)
+		return item
+	}
+	cachedUser := func(name string) *hnUser {
+		user, _ := s.cache.Peek("user:" + name).(*hnUser)
+		return user
+	}
+
+	if item := cachedItem(1); item == nil || item.Title != "Story, edited" {
+		t.Errorf("listed item 1 = %+v, want it refreshed", item)
+	}
+	if s.cache.Contains("item:30") {
+		t.Error("listed item 30 survived a failed refresh")
+	}
+	if s.cache.Contains("item:31") {
+		t.Error("listed item 31 was fetched although it was never cached")
+	}
+	if item := cachedItem(20); item == nil || item.Text != "comment 20" {
+		t.Errorf("unlisted item 20 = %+v, want the original", item)
+	}
+	if user := cachedUser("op"); user == nil || user.Karma != 11 {
+		t.Errorf("listed profile op = %+v, want it refreshed", user)
+	}
+	if user := cachedUser("alice"); user == nil || user.Karma != 20 {
+		t.Errorf("unlisted profile alice = %+v, want the original", user)
+	}
+	if stats := u.Stats(); stats.Polls != 1 || stats.Refreshed != 2 || stats.Evicted != 1 || stats.Failures != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// The same window again: those changes were applied already.
+	story.Title = "Story, edited twice"
+	fb.setItem(&story)
+	s.cache.Delete(updatesCacheKey)
+	u.poll(ctx)
+	if item := cachedItem(1); item == nil || item.Title != "Story, edited" {
+		t.Errorf("item 1 after a repeated window = %+v, want no refetch", item)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	itemTTLPolicyEnv = "HN_ITEM_TTLS"
+	// hnArchiveAge is when HN stops accepting votes and replies on an item.
+	hnArchiveAge = 14 * 24 * time.Hour
+	// defaultItemTTLPolicy keeps young items nearly live and lets settled ones
+	// sit in the cache for hours; updates.json invalidation covers edits.
+	defaultItemTTLPolicy = "10m=30s,1h=2m,6h=5m,48h=15m,*=1h,archived=6h,dead=6h,job=1h,missing=1m"
+)
+
+type itemTTLTier struct {
+	maxAge time.Duration
+	ttl    time.Duration
+	label  string
+}
+
+// itemTTLPolicy picks an item's cache TTL from its age, state and type.
+// Tiers are matched by age in ascending order; items past the last tier use
+// older until they are archived.
+type itemTTLPolicy struct {
+	tiers    []itemTTLTier
+	older    time.Duration
+	archived time.Duration
+	dead     time.Duration
+	job      time.Duration
+	missing  time.Duration
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+type itemTTLStats struct {
+	Label      string `json:"label"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	Chosen     int64  `json:"chosen"`
+}
+
+// parseItemTTLPolicy reads a comma-separated list of key=duration pairs on
+// top of defaultItemTTLPolicy. A key is either a maximum item age such as 6h,
+// or one of *, archived, dead, job and missing. Named keys left out keep
+// their defaults; any age key replaces the default tiers as a whole.
+func parseItemTTLPolicy(spec string) (*itemTTLPolicy, error) {
+	policy := &itemTTLPolicy{counts: make(map[string]int64)}
+	if err := policy.apply(defaultItemTTLPolicy); err != nil {
+		return nil, err
+	}
+	if err := policy.apply(spec); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (p *itemTTLPolicy) apply(spec string) error {
+	var tiers []itemTTLTier
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, rawTTL, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("item TTL entry %q must be key=duration", pair)
+		}
+		key = strings.TrimSpace(key)
+		ttl, err := time.ParseDuration(strings.TrimSpace(rawTTL))
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("item TTL entry %q has an invalid duration", pair)
+		}
+
+		switch key {
+		case "*":
+			p.older = ttl
+		case "archived":
+			p.archived = ttl
+		case "dead":
+			p.dead = ttl
+		case "job":
+			p.job = ttl
+		case "missing":
+			p.missing = ttl
+		default:
+			maxAge, err := time.ParseDuration(key)
+			if err != nil || maxAge <= 0 {
+				return fmt.Errorf("item TTL entry %q has an invalid age", pair)
+			}
+			tiers = append(tiers, itemTTLTier{maxAge: maxAge, ttl: ttl, label: "age<=" + key})
+		}
+	}
+	if len(tiers) > 0 {
+		sort.Slice(tiers, func(i, j int) bool {
+			return tiers[i].maxAge < tiers[j].maxAge
+		})
+		p.tiers = tiers
+	}
+	return nil
+}
+
+// TTL returns how long item may be served fresh from the cache. A nil item
+// is one Firebase reported as missing.
+func (p *itemTTLPolicy) TTL(item *hnItem, now time.Time) time.Duration {
+	ttl, label := p.choose(item, now)
+	p.mu.Lock()
+	p.counts[label]++
+	p.mu.Unlock()
+	return ttl
+}
+
+// Grace returns how long past ttl an item may still be served stale while it
+// is refreshed: as long again as the TTL, up to itemStaleGrace, so that the
+// short TTLs of young items are not undone by a long grace period.
+func (p *itemTTLPolicy) Grace(ttl time.Duration) time.Duration {
+	return min(ttl, itemStaleGrace)
+}
+
+func (p *itemTTLPolicy) choose(item *hnItem, now time.Time) (time.Duration, string) {
+	switch {
+	case item == nil:
+		return p.missing, "missing"
+	case item.Dead || item.Deleted:
+		return p.dead, "dead"
+	case item.Type == "job":
+		return p.job, "job"
+	}
+
+	age := now.Sub(time.Unix(item.Time, 0))
+	if age >= hnArchiveAge {
+		return p.archived, "archived"
+	}
+	for _, tier := range p.tiers {
+		if age <= tier.maxAge {
+			return tier.ttl, tier.label
+		}
+	}
+	return p.older, "older"
+}
+
+func (p *itemTTLPolicy) Stats() []itemTTLStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]itemTTLStats, 0, len(p.tiers)+5)
+	add := func(label string, ttl time.Duration) {
+		stats = append(stats, itemTTLStats{
+			Label:      label,
+			TTLSeconds: int64(ttl.Seconds()),
+			Chosen:     p.counts[label],
+		})
+	}
+	for _, tier := range p.tiers {
+		add(tier.label, tier.ttl)
+	}
+	add("older", p.older)
+	add("archived", p.archived)
+	add("dead", p.dead)
+	add("job", p.job)
+	add("missing", p.missing)
+	return stats
+}
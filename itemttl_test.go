@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseItemTTLPolicy(t *testing.T) {
+	policy, err := parseItemTTLPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.tiers) != 4 || policy.tiers[0] != (itemTTLTier{maxAge: 10 * time.Minute, ttl: 30 * time.Second, label: "age<=10m"}) {
+		t.Fatalf("default tiers = %+v", policy.tiers)
+	}
+
+	policy, err = parseItemTTLPolicy(" 2h = 1m , 30m=10s, job=5m ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []itemTTLTier{{maxAge: 30 * time.Minute, ttl: 10 * time.Second, label: "age<=30m"}, {maxAge: 2 * time.Hour, ttl: time.Minute, label: "age<=2h"}}
+	if len(policy.tiers) != 2 || policy.tiers[0] != want[0] || policy.tiers[1] != want[1] {
+		t.Errorf("custom tiers = %+v, want %+v", policy.tiers, want)
+	}
+	if policy.job != 5*time.Minute || policy.older != time.Hour || policy.archived != 6*time.Hour {
+		t.Errorf("named keys = job %v older %v archived %v", policy.job, policy.older, policy.archived)
+	}
+
+	for _, bad := range []string{"10m", "10m=soon", "10m=0s", "10m=-1s", "soon=1m", "0s=1m", "-5m=1m", "*=", "job=1m,=2m"} {
+		if _, err := parseItemTTLPolicy(bad); err == nil {
+			t.Errorf("parseItemTTLPolicy(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestItemTTLPolicyTTL(t *testing.T) {
+	policy, err := parseItemTTLPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	aged := func(age time.Duration) *hnItem {
+		return &hnItem{Type: "story", Time: now.Add(-age).Unix()}
+	}
+	tests := []struct {
+		name string
+		item *hnItem
+		want time.Duration
+	}{
+		{"missing", nil, time.Minute},
+		{"dead", &hnItem{Type: "comment", Dead: true, Time: now.Unix()}, 6 * time.Hour},
+		{"deleted", &hnItem{Type: "comment", Deleted: true, Time: now.Unix()}, 6 * time.Hour},
+		{"job", &hnItem{Type: "job", Time: now.Unix()}, time.Hour},
+		{"new", aged(time.Minute), 30 * time.Second},
+		{"tier boundary", aged(10 * time.Minute), 30 * time.Second},
+		{"second tier", aged(11 * time.Minute), 2 * time.Minute},
+		{"settled", aged(24 * time.Hour), 15 * time.Minute},
+		{"older", aged(72 * time.Hour), time.Hour},
+		{"archived", aged(hnArchiveAge), 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := policy.TTL(tt.item, now); got != tt.want {
+			t.Errorf("%s: TTL = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	counts := make(map[string]int64)
+	for _, stat := range policy.Stats() {
+		counts[stat.Label] = stat.Chosen
+	}
+	if counts["dead"] != 2 || counts["age<=10m"] != 2 || counts["archived"] != 1 || counts["missing"] != 1 {
+		t.Errorf("stats = %v", counts)
+	}
+}
+
+func TestItemTTLPolicyGrace(t *testing.T) {
+	policy, _ := parseItemTTLPolicy("")
+	for ttl, want := range map[time.Duration]time.Duration{30 * time.Second: 30 * time.Second, 5 * time.Minute: 5 * time.Minute, 6 * time.Hour: itemStaleGrace} {
+		if got := policy.Grace(ttl); got != want {
+			t.Errorf("Grace(%v) = %v, want %v", ttl, got, want)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"compress/gzip"
 	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,12 +15,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	readability "github.com/go-shiori/go-readability"
 )
 
 const (
@@ -28,7 +31,14 @@ const (
 	maxConcurrentFetch  = 8
 	firebaseTimeout     = 12 * time.Second
 	listCacheTTL        = 5 * time.Minute
-	itemCacheTTL        = 3 * time.Minute
+	userCacheTTL        = time.Hour
+	listStaleGrace      = 10 * time.Minute
+	// itemStaleGrace caps how long past its TTL an item is served stale;
+	// see itemTTLPolicy.Grace.
+	itemStaleGrace      = 15 * time.Minute
+	userStaleGrace      = 30 * time.Minute
+	cacheRefreshTimeout = 20 * time.Second
+	maxUserSubmissions  = 100
 	cacheMaxEntries     = 1200
 	cacheJanitorEvery   = 30 * time.Second
 	readerTimeout       = 10 * time.Second
@@ -47,9 +57,56 @@ const (
 	accessAllowMethods  = "Access-Control-Allow-Methods"
 	accessAllowHeaders  = "Access-Control-Allow-Headers"
 	contentTypeHeader   = "Content-Type"
+	etagHeader          = "ETag"
+	ifNoneMatchHeader   = "If-None-Match"
+	gzipETagSuffix      = "-gzip"
 	noContentStatusCode = http.StatusNoContent
 )
 
+type feedSpec struct {
+	name          string
+	path          string
+	maxItems      int
+	listTTL       time.Duration
+	prewarm       bool
+	prewarmReader bool
+}
+
+// feedRegistry lists every story feed the aggregator exposes, in the order
+// they are reported to clients. The first entry is the default feed used by
+// the index preload.
+var feedRegistry = []feedSpec{
+	{name: "best", path: "beststories.json", maxItems: maxStoriesPerFeed, listTTL: listCacheTTL, prewarm: true, prewarmReader: true},
+	{name: "top", path: "topstories.json", maxItems: maxStoriesPerFeed, listTTL: listCacheTTL, prewarm: true, prewarmReader: true},
+	{name: "new", path: "newstories.json", maxItems: maxStoriesPerFeed, listTTL: 2 * time.Minute, prewarm: true},
+	{name: "ask", path: "askstories.json", maxItems: 90, listTTL: listCacheTTL, prewarm: true},
+	{name: "show", path: "showstories.json", maxItems: 90, listTTL: listCacheTTL, prewarm: true},
+	{name: "job", path: "jobstories.json", maxItems: 60, listTTL: 15 * time.Minute},
+}
+
+func lookupFeed(name string) (feedSpec, bool) {
+	for _, feed := range feedRegistry {
+		if feed.name == name {
+			return feed, true
+		}
+	}
+	return feedSpec{}, false
+}
+
+func defaultFeed() feedSpec {
+	return feedRegistry[0]
+}
+
+func feedNames() []string {
+	names := make([]string, 0, len(feedRegistry))
+	for _, feed := range feedRegistry {
+		names = append(names, feed.name)
+	}
+	return names
+}
+
+// hnItem is a Firebase item as cached. loadItem sanitizes Text before the
+// item is stored, so responses can pass it through as is.
 type hnItem struct {
 	ID          int    `json:"id"`
 	Deleted     bool   `json:"deleted,omitempty"`
@@ -66,18 +123,27 @@ type hnItem struct {
 	Descendants int    `json:"descendants,omitempty"`
 }
 
+type hnUser struct {
+	ID        string `json:"id"`
+	Created   int64  `json:"created"`
+	Karma     int    `json:"karma"`
+	About     string `json:"about,omitempty"`
+	Submitted []int  `json:"submitted,omitempty"`
+}
+
 type storyResponse struct {
-	ID          int    `json:"id"`
-	Title       string `json:"title,omitempty"`
-	URL         string `json:"url,omitempty"`
-	Domain      string `json:"domain,omitempty"`
-	Score       int    `json:"score"`
-	By          string `json:"by,omitempty"`
-	Time        int64  `json:"time"`
-	Descendants int    `json:"descendants"`
-	Kids        []int  `json:"kids"`
-	Text        string `json:"text,omitempty"`
-	Type        string `json:"type"`
+	ID          int              `json:"id"`
+	Title       string           `json:"title,omitempty"`
+	URL         string           `json:"url,omitempty"`
+	Domain      string           `json:"domain,omitempty"`
+	Score       int              `json:"score"`
+	By          string           `json:"by,omitempty"`
+	Time        int64            `json:"time"`
+	Descendants int              `json:"descendants"`
+	Kids        []int            `json:"kids"`
+	Text        string           `json:"text,omitempty"`
+	Type        string           `json:"type"`
+	Preview     *previewResponse `json:"preview,omitempty"`
 }
 
 type itemResponse struct {
@@ -106,6 +172,30 @@ type commentResponse struct {
 	Type    string             `json:"type"`
 	Deleted bool               `json:"deleted"`
 	Dead    bool               `json:"dead"`
+	// Failed marks a placeholder for a comment that could not be fetched.
+	// Its replies are unknown rather than absent.
+	Failed bool `json:"failed,omitempty"`
+	// KidCount is the number of direct replies. MoreKids lists their IDs
+	// when the depth limit left them unexpanded.
+	KidCount int   `json:"kid_count"`
+	MoreKids []int `json:"more_kids,omitempty"`
+	// Matched is set, when the thread is filtered by author or text, on the
+	// comments that passed the filter; the others are only there as context.
+	Matched bool `json:"matched,omitempty"`
+	// LoadedDescendants, MaxDepth, NewestReply and Participants describe the
+	// loaded subtree below the comment, before any sort or filter, and a
+	// comment's own author is a participant. Replies left in MoreKids count
+	// once each with nothing below them, so LoadedDescendants is a lower
+	// bound on the real subtree size. They are left out of streamed records,
+	// which precede their replies.
+	LoadedDescendants int   `json:"loaded_descendants,omitempty"`
+	MaxDepth          int   `json:"max_depth,omitempty"`
+	NewestReply       int64 `json:"newest_reply,omitempty"`
+	Participants      int   `json:"participants,omitempty"`
+
+	// authors is the set behind Participants, kept until the parent has
+	// merged it into its own.
+	authors map[string]struct{}
 }
 
 type threadResponse struct {
@@ -121,31 +211,73 @@ type threadResponse struct {
 	Text        string             `json:"text,omitempty"`
 	Type        string             `json:"type"`
 	Comments    []*commentResponse `json:"comments"`
+	// Parent is set when Comments are the replies to one comment rather
+	// than to the story. NextCursor continues the listing when limit cut it.
+	Parent     int    `json:"parent,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Partial is set when some comments failed to load; they appear in the
+	// tree as placeholders and their IDs in FailedIDs, ready to be retried.
+	Partial   bool  `json:"partial"`
+	FailedIDs []int `json:"failed_ids,omitempty"`
+	// Participants summarizes the authors of the comments listed.
+	Participants threadParticipants `json:"participants"`
+}
+
+type userResponse struct {
+	ID             string         `json:"id"`
+	Created        int64          `json:"created"`
+	Karma          int            `json:"karma"`
+	About          string         `json:"about,omitempty"`
+	SubmittedCount int            `json:"submitted_count"`
+	Offset         int            `json:"offset"`
+	Limit          int            `json:"limit"`
+	Submissions    []itemResponse `json:"submissions"`
 }
 
 type readerResponse struct {
-	URL         string `json:"url"`
-	FinalURL    string `json:"final_url"`
-	Title       string `json:"title,omitempty"`
-	Byline      string `json:"byline,omitempty"`
-	SiteName    string `json:"site_name,omitempty"`
-	Excerpt     string `json:"excerpt,omitempty"`
-	Content     string `json:"content,omitempty"`
-	TextContent string `json:"text_content,omitempty"`
-	Length      int    `json:"length,omitempty"`
+	URL            string         `json:"url"`
+	FinalURL       string         `json:"final_url"`
+	Title          string         `json:"title,omitempty"`
+	Byline         string         `json:"byline,omitempty"`
+	SiteName       string         `json:"site_name,omitempty"`
+	Excerpt        string         `json:"excerpt,omitempty"`
+	Content        string         `json:"content,omitempty"`
+	TextContent    string         `json:"text_content,omitempty"`
+	Length         int            `json:"length,omitempty"`
+	WordCount      int            `json:"word_count,omitempty"`
+	ReadingMinutes int            `json:"reading_minutes,omitempty"`
+	Language       string         `json:"language,omitempty"`
+	Outline        []outlineEntry `json:"outline,omitempty"`
+	Charset        string         `json:"charset,omitempty"`
+	Document       *documentInfo  `json:"document,omitempty"`
+	Source         string         `json:"source,omitempty"`
+	Paywalled      bool           `json:"paywalled,omitempty"`
 }
 
 type server struct {
-	client    *http.Client
-	cache     *ttlLRUCache
-	indexHTML []byte
+	client       *http.Client
+	readerClient *http.Client
+	cache        *ttlLRUCache
+	readers      *ttlLRUCache
+	images       *ttlLRUCache
+	flights      *flightGroup
+	stream       *storyStream
+	updates      *updatesWatcher
+	itemTTLs     *itemTTLPolicy
+	archives     []archiveSource
+	indexHTML    []byte
 }
 
+// cacheEntry is fresh until staleAt and may still be served, while a single
+// background refresh runs, until expiresAt.
 type cacheEntry struct {
-	key       string
-	value     any
-	expiresAt time.Time
-	element   *list.Element
+	key        string
+	value      any
+	staleAt    time.Time
+	expiresAt  time.Time
+	refreshing bool
+	size       int64
+	element    *list.Element
 }
 
 type ttlLRUCache struct {
@@ -153,10 +285,30 @@ type ttlLRUCache struct {
 	entries    map[string]*cacheEntry
 	order      *list.List
 	maxEntries int
+	maxBytes   int64
+	sizeOf     func(any) int64
+	bytes      int64
+	disk       *diskCache
+	hits       int64
+	staleHits  int64
+	diskHits   int64
+	misses     int64
+}
+
+type cacheStats struct {
+	Entries   int            `json:"entries"`
+	Bytes     int64          `json:"bytes,omitempty"`
+	Hits      int64          `json:"hits"`
+	StaleHits int64          `json:"stale_hits"`
+	DiskHits  int64          `json:"disk_hits"`
+	Misses    int64          `json:"misses"`
+	ItemTTLs  []itemTTLStats `json:"item_ttls,omitempty"`
 }
 
 type nilItemMarker struct{}
 
+type nilUserMarker struct{}
+
 func newTTLRUCache(maxEntries int) *ttlLRUCache {
 	return &ttlLRUCache{
 		entries:    make(map[string]*cacheEntry, maxEntries),
@@ -165,39 +317,128 @@ func newTTLRUCache(maxEntries int) *ttlLRUCache {
 	}
 }
 
+// newSizedTTLRUCache is newTTLRUCache with a second bound of maxBytes on the
+// total sizeOf the resident values, for caches holding large documents.
+// Values bigger than maxBytes on their own are not cached.
+func newSizedTTLRUCache(maxEntries int, maxBytes int64, sizeOf func(any) int64) *ttlLRUCache {
+	c := newTTLRUCache(maxEntries)
+	c.maxBytes = maxBytes
+	c.sizeOf = sizeOf
+	return c
+}
+
 func (c *ttlLRUCache) Get(key string) (any, bool) {
+	value, ok, _ := c.Lookup(key)
+	return value, ok
+}
+
+// Lookup returns the cached value for key, falling back to the disk tier on
+// a memory miss. refresh is true for exactly one caller once the entry has
+// passed its soft TTL; that caller is expected to reload the value and either
+// Set it or call ReleaseRefresh on failure.
+func (c *ttlLRUCache) Lookup(key string) (value any, ok bool, refresh bool) {
 	c.mu.Lock()
+	entry, ok := c.entries[key]
+	now := time.Now()
+	if ok && now.After(entry.expiresAt) {
+		c.removeEntryLocked(entry)
+		ok = false
+	}
+	if !ok && c.disk != nil {
+		c.mu.Unlock()
+		diskValue, staleAt, expiresAt, found := c.disk.Load(key)
+		c.mu.Lock()
+		if found {
+			entry, ok = c.entries[key]
+			if !ok {
+				entry = &cacheEntry{
+					key:       key,
+					value:     diskValue,
+					staleAt:   staleAt,
+					expiresAt: expiresAt,
+					size:      c.sizeLocked(diskValue),
+					element:   c.order.PushFront(key),
+				}
+				c.entries[key] = entry
+				c.bytes += entry.size
+				c.evictOverflowLocked()
+				ok = true
+			}
+			c.diskHits++
+		}
+	}
 	defer c.mu.Unlock()
 
-	entry, ok := c.entries[key]
 	if !ok {
-		return nil, false
+		c.misses++
+		return nil, false, false
 	}
 
-	now := time.Now()
-	if now.After(entry.expiresAt) {
-		c.removeEntryLocked(entry)
-		return nil, false
+	c.order.MoveToFront(entry.element)
+	if now.After(entry.staleAt) {
+		c.staleHits++
+		if !entry.refreshing {
+			entry.refreshing = true
+			return entry.value, true, true
+		}
+		return entry.value, true, false
 	}
+	c.hits++
+	return entry.value, true, false
+}
 
-	c.order.MoveToFront(entry.element)
-	return entry.value, true
+// ReleaseRefresh allows another Lookup to claim the refresh for key after a
+// background reload failed.
+func (c *ttlLRUCache) ReleaseRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		entry.refreshing = false
+	}
 }
 
 func (c *ttlLRUCache) Set(key string, value any, ttl time.Duration) {
+	c.SetWithGrace(key, value, ttl, 0)
+}
+
+// SetWithGrace stores value as fresh for ttl and servable as stale for a
+// further grace period.
+func (c *ttlLRUCache) SetWithGrace(key string, value any, ttl time.Duration, grace time.Duration) {
 	if ttl <= 0 {
 		return
 	}
+	if grace < 0 {
+		grace = 0
+	}
+	if c.maxBytes > 0 && c.sizeOf(value) > c.maxBytes {
+		return
+	}
 
+	now := time.Now()
+	staleAt := now.Add(ttl)
+	expiresAt := now.Add(ttl + grace)
+	c.setEntry(key, value, staleAt, expiresAt, now)
+	if c.disk != nil {
+		c.disk.Store(key, value, staleAt, expiresAt)
+	}
+}
+
+func (c *ttlLRUCache) setEntry(key string, value any, staleAt time.Time, expiresAt time.Time, now time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	now := time.Now()
+	size := c.sizeLocked(value)
 	if entry, ok := c.entries[key]; ok {
+		c.bytes += size - entry.size
 		entry.value = value
-		entry.expiresAt = now.Add(ttl)
+		entry.staleAt = staleAt
+		entry.expiresAt = expiresAt
+		entry.refreshing = false
+		entry.size = size
 		c.order.MoveToFront(entry.element)
 		c.evictExpiredLocked(now)
+		c.evictOverflowLocked()
 		return
 	}
 
@@ -205,14 +446,63 @@ func (c *ttlLRUCache) Set(key string, value any, ttl time.Duration) {
 	c.entries[key] = &cacheEntry{
 		key:       key,
 		value:     value,
-		expiresAt: now.Add(ttl),
+		staleAt:   staleAt,
+		expiresAt: expiresAt,
+		size:      size,
 		element:   elem,
 	}
+	c.bytes += size
 
 	c.evictExpiredLocked(now)
 	c.evictOverflowLocked()
 }
 
+// Contains reports whether key is resident in memory, without touching LRU
+// order, the disk tier or the hit counters.
+func (c *ttlLRUCache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+// Peek returns the in-memory value for key, stale or not, without touching
+// LRU order, the disk tier or the hit counters.
+func (c *ttlLRUCache) Peek(key string) any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		return entry.value
+	}
+	return nil
+}
+
+// Delete drops key from memory and the disk tier.
+func (c *ttlLRUCache) Delete(key string) {
+	c.mu.Lock()
+	c.removeEntryLocked(c.entries[key])
+	c.mu.Unlock()
+	if c.disk != nil {
+		c.disk.Delete(key)
+	}
+}
+
+func (c *ttlLRUCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return cacheStats{
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+		Hits:      c.hits,
+		StaleHits: c.staleHits,
+		DiskHits:  c.diskHits,
+		Misses:    c.misses,
+	}
+}
+
 func (c *ttlLRUCache) StartJanitor(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
@@ -233,7 +523,7 @@ func (c *ttlLRUCache) evictExpiredLocked(now time.Time) {
 }
 
 func (c *ttlLRUCache) evictOverflowLocked() {
-	for len(c.entries) > c.maxEntries {
+	for len(c.entries) > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
 		back := c.order.Back()
 		if back == nil {
 			return
@@ -254,17 +544,127 @@ func (c *ttlLRUCache) removeEntryLocked(entry *cacheEntry) {
 	}
 	delete(c.entries, entry.key)
 	c.order.Remove(entry.element)
+	c.bytes -= entry.size
+}
+
+func (c *ttlLRUCache) sizeLocked(value any) int64 {
+	if c.sizeOf == nil {
+		return 0
+	}
+	return c.sizeOf(value)
+}
+
+// flightGroup coalesces concurrent upstream fetches for the same cache key so
+// that a burst of misses results in a single Firebase request.
+type flightGroup struct {
+	mu        sync.Mutex
+	calls     map[string]*flightCall
+	upstream  atomic.Int64
+	coalesced atomic.Int64
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  any
+	err  error
+}
+
+type flightStats struct {
+	UpstreamCalls  int64 `json:"upstream_calls"`
+	CoalescedCalls int64 `json:"coalesced_calls"`
+	InFlight       int   `json:"in_flight"`
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn once per key among concurrent callers. fn receives a context
+// that is not canceled with the caller's, so one client disconnecting does
+// not fail the fetch for everyone else waiting on it; each caller still stops
+// waiting when its own ctx is done.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(context.Context) (any, error)) (any, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		g.mu.Unlock()
+		g.coalesced.Add(1)
+	} else {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		g.mu.Unlock()
+		g.upstream.Add(1)
+
+		go func() {
+			// fn runs outside any request goroutine, so a panic here would
+			// take down the process rather than fail one request.
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.Printf("flight %s panicked: %v\n%s", key, recovered, debug.Stack())
+					call.val, call.err = nil, fmt.Errorf("flight %s panicked: %v", key, recovered)
+				}
+				g.mu.Lock()
+				delete(g.calls, key)
+				g.mu.Unlock()
+				close(call.done)
+			}()
+			call.val, call.err = fn(context.WithoutCancel(ctx))
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) Stats() flightStats {
+	g.mu.Lock()
+	inFlight := len(g.calls)
+	g.mu.Unlock()
+	return flightStats{
+		UpstreamCalls:  g.upstream.Load(),
+		CoalescedCalls: g.coalesced.Load(),
+		InFlight:       inFlight,
+	}
 }
 
 func newServer() *server {
 	cache := newTTLRUCache(cacheMaxEntries)
 	cache.StartJanitor(cacheJanitorEvery)
+	readers := newSizedTTLRUCache(readerCacheEntries, readerCacheMaxBytes, readerCacheSize)
+	readers.StartJanitor(cacheJanitorEvery)
+	images := newSizedTTLRUCache(imageCacheEntries, imageCacheMaxBytes, imageCacheSize)
+	images.StartJanitor(cacheJanitorEvery)
+	if dir := strings.TrimSpace(os.Getenv(diskCacheDirEnv)); dir != "" {
+		disk, err := newDiskCache(dir, diskCacheMaxBytes)
+		if err != nil {
+			log.Printf("disk cache disabled, dir=%s: %v", dir, err)
+		} else {
+			disk.StartCompactor(diskCacheCompactEach)
+			cache.disk = disk
+			readers.disk = disk
+			log.Printf("disk cache enabled at %s", dir)
+		}
+	}
+	itemTTLs, err := parseItemTTLPolicy(os.Getenv(itemTTLPolicyEnv))
+	if err != nil {
+		log.Printf("item TTL policy %s ignored: %v", itemTTLPolicyEnv, err)
+		itemTTLs, _ = parseItemTTLPolicy("")
+	}
+	archives, err := parseArchiveSources(os.Getenv(archiveSourcesEnv))
+	if err != nil {
+		log.Printf("archive sources %s ignored: %v", archiveSourcesEnv, err)
+		archives, _ = parseArchiveSources("")
+	}
 	indexHTML, err := os.ReadFile("./public/index.html")
 	if err != nil {
 		log.Printf("index template load failed: %v", err)
 	}
 
-	return &server{
+	s := &server{
 		client: &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConns:        100,
@@ -272,20 +672,37 @@ func newServer() *server {
 				IdleConnTimeout:     90 * time.Second,
 			},
 		},
-		cache:     cache,
-		indexHTML: indexHTML,
-	}
+		readerClient: newGuardedClient(isPublicAddr),
+		cache:        cache,
+		readers:      readers,
+		images:       images,
+		flights:      newFlightGroup(),
+		itemTTLs:     itemTTLs,
+		archives:     archives,
+		indexHTML:    indexHTML,
+	}
+	s.stream = newStoryStream(s)
+	s.updates = newUpdatesWatcher(s)
+	return s
 }
 
 func main() {
 	s := newServer()
 	go s.prewarm(context.Background())
+	go s.updates.Run(context.Background())
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/stories", s.handleStories)
 	mux.HandleFunc("/api/item", s.handleItem)
 	mux.HandleFunc("/api/thread", s.handleThread)
+	mux.HandleFunc("/api/thread/retry", s.handleThreadRetry)
 	mux.HandleFunc("/api/reader", s.handleReader)
+	mux.HandleFunc(imageProxyPath, s.handleImage)
+	mux.HandleFunc("/api/preview", s.handlePreview)
+	mux.HandleFunc("/api/user", s.handleUser)
+	mux.HandleFunc("/api/stream", s.handleStream)
+	mux.HandleFunc("/api/metrics", s.handleMetrics)
+	mux.HandleFunc(syndicationPathPrefix, s.handleSyndication)
 	mux.Handle("/", s.handleIndex(staticFileHandler(http.Dir("./public"))))
 
 	port := os.Getenv("PORT")
@@ -312,13 +729,14 @@ func (s *server) handleStories(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	feed := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("feed")))
-	if feed == "" {
+	feedName := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("feed")))
+	if feedName == "" {
 		writeError(w, http.StatusBadRequest, "missing feed parameter")
 		return
 	}
-	if feed != "best" && feed != "top" && feed != "new" {
-		writeError(w, http.StatusBadRequest, "feed must be one of: best, top, new")
+	feed, ok := lookupFeed(feedName)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "feed must be one of: "+strings.Join(feedNames(), ", "))
 		return
 	}
 
@@ -339,20 +757,52 @@ func (s *server) handleStories(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
 			return
 		}
-		if parsedLimit > maxStoriesPerFeed {
-			parsedLimit = maxStoriesPerFeed
+		if parsedLimit > feed.maxItems {
+			parsedLimit = feed.maxItems
 		}
 		limit = parsedLimit
 	}
 
-	stories, err := s.getStoriesPage(r.Context(), feed, offset, limit)
+	withPreviews := false
+	if rawPreview := strings.TrimSpace(r.URL.Query().Get("preview")); rawPreview != "" {
+		parsedPreview, err := strconv.ParseBool(rawPreview)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "preview must be a boolean")
+			return
+		}
+		withPreviews = parsedPreview
+	}
+
+	stories, err := s.getStoriesPage(r.Context(), feed.name, offset, limit)
 	if err != nil {
-		log.Printf("story page fetch failed for feed=%s offset=%d limit=%d: %v", feed, offset, limit, err)
+		log.Printf("story page fetch failed for feed=%s offset=%d limit=%d: %v", feed.name, offset, limit, err)
 		writeError(w, http.StatusBadGateway, "failed to hydrate stories")
 		return
 	}
+	if withPreviews {
+		s.attachPreviews(r.Context(), stories)
+	}
+
+	writeJSONCached(w, r, http.StatusOK, stories, 60*time.Second, 30*time.Second)
+}
 
-	writeJSONCached(w, http.StatusOK, stories, 60*time.Second, 30*time.Second)
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	cache := s.cache.Stats()
+	cache.ItemTTLs = s.itemTTLs.Stats()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"cache":        cache,
+		"reader_cache": s.readers.Stats(),
+		"singleflight": s.flights.Stats(),
+		"updates":      s.updates.Stats(),
+	})
 }
 
 func (s *server) handleIndex(static http.Handler) http.Handler {
@@ -378,13 +828,14 @@ func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	preloadStories, err := s.getStoriesPage(r.Context(), "best", 0, defaultStoriesLimit)
+	feed := defaultFeed()
+	preloadStories, err := s.getStoriesPage(r.Context(), feed.name, 0, defaultStoriesLimit)
 	if err != nil {
 		log.Printf("index preload failed: %v", err)
 	}
 
 	payload := map[string]any{
-		"feed":    "best",
+		"feed":    feed.name,
 		"offset":  0,
 		"limit":   defaultStoriesLimit,
 		"stories": preloadStories,
@@ -408,14 +859,19 @@ func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *server) getStoriesPage(ctx context.Context, feed string, offset int, limit int) ([]storyResponse, error) {
-	ids, err := s.fetchStoryIDs(ctx, feed)
+func (s *server) getStoriesPage(ctx context.Context, feedName string, offset int, limit int) ([]storyResponse, error) {
+	feed, ok := lookupFeed(feedName)
+	if !ok {
+		return nil, fmt.Errorf("invalid feed: %s", feedName)
+	}
+
+	ids, err := s.fetchStoryIDs(ctx, feed.name)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ids) > maxStoriesPerFeed {
-		ids = ids[:maxStoriesPerFeed]
+	if len(ids) > feed.maxItems {
+		ids = ids[:feed.maxItems]
 	}
 	if offset >= len(ids) {
 		return []storyResponse{}, nil
@@ -466,7 +922,86 @@ func (s *server) handleItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSONCached(w, http.StatusOK, toItemResponse(item), 120*time.Second, 60*time.Second)
+	writeJSONCached(w, r, http.StatusOK, toItemResponse(item), 120*time.Second, 60*time.Second)
+}
+
+func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	username, ok := parseUsername(r.URL.Query().Get("id"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid id parameter")
+		return
+	}
+
+	offset := 0
+	if rawOffset := strings.TrimSpace(r.URL.Query().Get("offset")); rawOffset != "" {
+		parsedOffset, err := strconv.Atoi(rawOffset)
+		if err != nil || parsedOffset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		offset = parsedOffset
+	}
+
+	limit := defaultStoriesLimit
+	if rawLimit := strings.TrimSpace(r.URL.Query().Get("limit")); rawLimit != "" {
+		parsedLimit, err := strconv.Atoi(rawLimit)
+		if err != nil || parsedLimit <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if parsedLimit > maxUserSubmissions {
+			parsedLimit = maxUserSubmissions
+		}
+		limit = parsedLimit
+	}
+
+	user, err := s.fetchUser(r.Context(), username)
+	if err != nil {
+		log.Printf("user fetch failed id=%s: %v", username, err)
+		writeError(w, http.StatusBadGateway, "failed to fetch user")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	submissions := []itemResponse{}
+	if offset < len(user.Submitted) {
+		end := offset + limit
+		if end > len(user.Submitted) {
+			end = len(user.Submitted)
+		}
+		items, err := s.fetchItemsConcurrently(r.Context(), user.Submitted[offset:end])
+		if err != nil {
+			log.Printf("user submissions fetch failed id=%s offset=%d limit=%d: %v", username, offset, limit, err)
+			writeError(w, http.StatusBadGateway, "failed to hydrate submissions")
+			return
+		}
+		for _, item := range items {
+			if item == nil {
+				continue
+			}
+			submissions = append(submissions, toItemResponse(item))
+		}
+	}
+
+	writeJSONCached(w, r, http.StatusOK, userResponse{
+		ID:             user.ID,
+		Created:        user.Created,
+		Karma:          user.Karma,
+		About:          sanitizeHTML(user.About),
+		SubmittedCount: len(user.Submitted),
+		Offset:         offset,
+		Limit:          limit,
+		Submissions:    submissions,
+	}, 120*time.Second, 60*time.Second)
 }
 
 func (s *server) handleThread(w http.ResponseWriter, r *http.Request) {
@@ -497,16 +1032,75 @@ func (s *server) handleThread(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	threadCtx, threadCancel := context.WithTimeout(r.Context(), 45*time.Second)
+	opts, problem := parseThreadOptions(r.URL.Query())
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+	view, problem := parseThreadView(r.URL.Query())
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+	if view.byOP {
+		view.author = story.By
+	}
+	streaming, problem := wantsThreadStream(r)
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+	if streaming && !view.isZero() {
+		writeError(w, http.StatusBadRequest, "sort and filter options are not available when streaming")
+		return
+	}
+	replies, listParent := story.Kids, story.ID
+	if opts.parent != 0 && opts.parent != story.ID {
+		parent, err := s.fetchThreadComment(r.Context(), story.ID, opts.parent)
+		if errors.Is(err, errNotInThread) {
+			writeError(w, http.StatusBadRequest, "parent must be a comment in this thread")
+			return
+		}
+		if err != nil {
+			log.Printf("thread parent fetch failed id=%d parent=%d: %v", id, opts.parent, err)
+			writeError(w, http.StatusBadGateway, "failed to fetch parent comment")
+			return
+		}
+		replies, listParent = parent.Kids, parent.ID
+	}
+	replies, nextCursor := opts.page(replies)
+	walk := &commentWalk{maxDepth: opts.maxDepth, parent: listParent, offset: opts.offset}
+
+	threadCtx, threadCancel := context.WithTimeout(r.Context(), threadTimeout)
 	defer threadCancel()
-	comments, err := s.fetchCommentForest(threadCtx, story.Kids)
+	if streaming {
+		s.streamThread(threadCtx, w, story, opts, replies, nextCursor, walk)
+		return
+	}
+	comments, err := s.fetchCommentForest(threadCtx, replies, walk)
 	if err != nil {
 		log.Printf("thread comment hydration failed id=%d: %v", id, err)
 		writeError(w, http.StatusBadGateway, "failed to hydrate comment tree")
 		return
 	}
-
-	writeJSONCached(w, http.StatusOK, toThreadResponse(story, comments), 120*time.Second, 60*time.Second)
+	participants := summarizeParticipants(comments, story.By)
+	comments = view.apply(comments)
+
+	thread := toThreadResponse(story, comments)
+	thread.Participants = participants
+	if listParent != story.ID {
+		thread.Parent = listParent
+	}
+	thread.NextCursor = nextCursor
+	thread.FailedIDs = walk.failures()
+	thread.Partial = len(thread.FailedIDs) > 0
+	if thread.Partial {
+		// A retry should not be answered from a browser cache.
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSONConditional(w, r, http.StatusOK, thread)
+		return
+	}
+	writeJSONCached(w, r, http.StatusOK, thread, 120*time.Second, 60*time.Second)
 }
 
 func (s *server) handleReader(w http.ResponseWriter, r *http.Request) {
@@ -516,116 +1110,98 @@ func (s *server) handleReader(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rawURL := strings.TrimSpace(r.URL.Query().Get("url"))
-	if rawURL == "" {
-		writeError(w, http.StatusBadRequest, "missing url parameter")
+	parsedURL, problem := parseExternalURL(r.URL.Query().Get("url"))
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
 		return
 	}
 
-	parsedURL, err := url.ParseRequestURI(rawURL)
-	if err != nil || parsedURL.Host == "" {
-		writeError(w, http.StatusBadRequest, "invalid url parameter")
-		return
-	}
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		writeError(w, http.StatusBadRequest, "url must use http or https")
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(r.Context(), readerTimeout)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsedURL.String(), nil)
-	if err != nil {
-		writeError(w, http.StatusBadRequest, "invalid request URL")
+	format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+	switch format {
+	case "", "json", "markdown", "md", "text", "txt":
+	default:
+		writeError(w, http.StatusBadRequest, "format must be one of: json, markdown, text")
 		return
 	}
-	req.Header.Set("Accept", "text/html,application/xhtml+xml")
-	req.Header.Set("User-Agent", readerUserAgent)
 
-	resp, err := s.client.Do(req)
+	article, err := s.fetchReader(r.Context(), parsedURL)
 	if err != nil {
-		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-			writeError(w, http.StatusGatewayTimeout, "reader request timed out")
+		var readerErr *readerError
+		if errors.As(err, &readerErr) {
+			writeError(w, readerErr.status, readerErr.message)
 			return
 		}
-		log.Printf("reader request failed url=%s: %v", parsedURL.String(), err)
+		log.Printf("reader fetch failed url=%s: %v", parsedURL.String(), err)
 		writeError(w, http.StatusBadGateway, "failed to fetch article")
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < http.StatusOK || resp.StatusCode > 299 {
-		writeError(w, http.StatusBadGateway, fmt.Sprintf("upstream request failed (%d)", resp.StatusCode))
-		return
+	switch format {
+	case "markdown", "md":
+		rendered, err := renderArticleMarkdown(article)
+		if err != nil {
+			log.Printf("reader markdown render failed url=%s: %v", parsedURL.String(), err)
+			writeError(w, http.StatusInternalServerError, "failed to render article")
+			return
+		}
+		writeBodyConditional(w, r, http.StatusOK, markdownContentType, []byte(rendered))
+	case "text", "txt":
+		rendered, err := renderArticleText(article)
+		if err != nil {
+			log.Printf("reader text render failed url=%s: %v", parsedURL.String(), err)
+			writeError(w, http.StatusInternalServerError, "failed to render article")
+			return
+		}
+		writeBodyConditional(w, r, http.StatusOK, plainTextContentType, []byte(rendered))
+	default:
+		writeJSONConditional(w, r, http.StatusOK, article)
 	}
+}
 
-	contentType := strings.ToLower(resp.Header.Get(contentTypeHeader))
-	if !strings.Contains(contentType, htmlContentType) && !strings.Contains(contentType, xhtmlContentType) {
-		writeError(w, http.StatusUnsupportedMediaType, "URL did not return HTML")
-		return
+func (s *server) fetchStoryIDs(ctx context.Context, feedName string) ([]int, error) {
+	feed, ok := lookupFeed(feedName)
+	if !ok {
+		return nil, fmt.Errorf("invalid feed: %s", feedName)
 	}
 
-	finalURL := parsedURL
-	if resp.Request != nil && resp.Request.URL != nil {
-		finalURL = resp.Request.URL
+	cacheKey := "list:" + feed.name
+	if cached, ok, refresh := s.cache.Lookup(cacheKey); ok {
+		if ids, ok := cached.([]int); ok {
+			if refresh {
+				s.refreshInBackground(s.cache, cacheKey, func(ctx context.Context) error {
+					_, err := s.loadStoryIDs(ctx, feed)
+					return err
+				})
+			}
+			return append([]int(nil), ids...), nil
+		}
 	}
 
-	limited := io.LimitReader(resp.Body, readerMaxHTMLBytes)
-	article, err := readability.FromReader(limited, finalURL)
+	ids, err := s.loadStoryIDs(ctx, feed)
 	if err != nil {
-		log.Printf("readability parse failed url=%s: %v", parsedURL.String(), err)
-		writeError(w, http.StatusBadGateway, "failed to extract article")
-		return
-	}
-
-	if strings.TrimSpace(article.Content) == "" && strings.TrimSpace(article.TextContent) == "" {
-		writeError(w, http.StatusBadGateway, "article content was empty")
-		return
+		return nil, err
 	}
-
-	writeJSON(w, http.StatusOK, readerResponse{
-		URL:         parsedURL.String(),
-		FinalURL:    finalURL.String(),
-		Title:       article.Title,
-		Byline:      article.Byline,
-		SiteName:    article.SiteName,
-		Excerpt:     article.Excerpt,
-		Content:     article.Content,
-		TextContent: article.TextContent,
-		Length:      article.Length,
-	})
+	return append([]int{}, ids...), nil
 }
 
-func (s *server) fetchStoryIDs(ctx context.Context, feed string) ([]int, error) {
-	path := ""
-	switch feed {
-	case "best":
-		path = "beststories.json"
-	case "top":
-		path = "topstories.json"
-	case "new":
-		path = "newstories.json"
-	default:
-		return nil, fmt.Errorf("invalid feed: %s", feed)
-	}
-
-	cacheKey := "list:" + feed
-	if cached, ok := s.cache.Get(cacheKey); ok {
-		if ids, ok := cached.([]int); ok {
-			return append([]int(nil), ids...), nil
+func (s *server) loadStoryIDs(ctx context.Context, feed feedSpec) ([]int, error) {
+	cacheKey := "list:" + feed.name
+	result, err := s.flights.Do(ctx, cacheKey, func(ctx context.Context) (any, error) {
+		var ids []int
+		if err := s.fetchFirebaseJSON(ctx, feed.path, &ids); err != nil {
+			return nil, err
+		}
+		if ids == nil {
+			ids = []int{}
 		}
-	}
 
-	var ids []int
-	if err := s.fetchFirebaseJSON(ctx, path, &ids); err != nil {
+		s.cache.SetWithGrace(cacheKey, ids, feed.listTTL, listStaleGrace)
+		return ids, nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	if ids == nil {
-		ids = []int{}
-	}
-
-	s.cache.Set(cacheKey, append([]int(nil), ids...), listCacheTTL)
+	ids, _ := result.([]int)
 	return ids, nil
 }
 
@@ -635,7 +1211,13 @@ func (s *server) fetchItem(ctx context.Context, id int) (*hnItem, error) {
 	}
 
 	cacheKey := fmt.Sprintf("item:%d", id)
-	if cached, ok := s.cache.Get(cacheKey); ok {
+	if cached, ok, refresh := s.cache.Lookup(cacheKey); ok {
+		if refresh {
+			s.refreshInBackground(s.cache, cacheKey, func(ctx context.Context) error {
+				_, err := s.loadItem(ctx, id)
+				return err
+			})
+		}
 		switch v := cached.(type) {
 		case *hnItem:
 			return cloneItem(v), nil
@@ -644,24 +1226,109 @@ func (s *server) fetchItem(ctx context.Context, id int) (*hnItem, error) {
 		}
 	}
 
-	var raw json.RawMessage
-	itemPath := fmt.Sprintf("item/%d.json", id)
-	if err := s.fetchFirebaseJSON(ctx, itemPath, &raw); err != nil {
+	item, err := s.loadItem(ctx, id)
+	if err != nil {
 		return nil, err
 	}
+	return cloneItem(item), nil
+}
 
-	if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
-		s.cache.Set(cacheKey, nilItemMarker{}, itemCacheTTL)
-		return nil, nil
+func (s *server) loadItem(ctx context.Context, id int) (*hnItem, error) {
+	cacheKey := fmt.Sprintf("item:%d", id)
+	result, err := s.flights.Do(ctx, cacheKey, func(ctx context.Context) (any, error) {
+		var raw json.RawMessage
+		itemPath := fmt.Sprintf("item/%d.json", id)
+		if err := s.fetchFirebaseJSON(ctx, itemPath, &raw); err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			s.cache.Set(cacheKey, nilItemMarker{}, s.itemTTLs.TTL(nil, time.Now()))
+			return nil, nil
+		}
+
+		var item hnItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		item.Text = sanitizeHTML(item.Text)
+
+		ttl := s.itemTTLs.TTL(&item, time.Now())
+		s.cache.SetWithGrace(cacheKey, &item, ttl, s.itemTTLs.Grace(ttl))
+		return &item, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	item, _ := result.(*hnItem)
+	return item, nil
+}
+
+func (s *server) fetchUser(ctx context.Context, username string) (*hnUser, error) {
+	cacheKey := "user:" + username
+	if cached, ok, refresh := s.cache.Lookup(cacheKey); ok {
+		if refresh {
+			s.refreshInBackground(s.cache, cacheKey, func(ctx context.Context) error {
+				_, err := s.loadUser(ctx, username)
+				return err
+			})
+		}
+		switch v := cached.(type) {
+		case *hnUser:
+			return cloneUser(v), nil
+		case nilUserMarker:
+			return nil, nil
+		}
 	}
 
-	var item hnItem
-	if err := json.Unmarshal(raw, &item); err != nil {
+	user, err := s.loadUser(ctx, username)
+	if err != nil {
 		return nil, err
 	}
+	return cloneUser(user), nil
+}
+
+func (s *server) loadUser(ctx context.Context, username string) (*hnUser, error) {
+	cacheKey := "user:" + username
+	result, err := s.flights.Do(ctx, cacheKey, func(ctx context.Context) (any, error) {
+		var raw json.RawMessage
+		userPath := "user/" + url.PathEscape(username) + ".json"
+		if err := s.fetchFirebaseJSON(ctx, userPath, &raw); err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			s.cache.Set(cacheKey, nilUserMarker{}, userCacheTTL)
+			return nil, nil
+		}
+
+		var user hnUser
+		if err := json.Unmarshal(raw, &user); err != nil {
+			return nil, err
+		}
 
-	s.cache.Set(cacheKey, cloneItem(&item), itemCacheTTL)
-	return &item, nil
+		s.cache.SetWithGrace(cacheKey, &user, userCacheTTL, userStaleGrace)
+		return &user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user, _ := result.(*hnUser)
+	return user, nil
+}
+
+// refreshInBackground reloads a stale entry of cache without holding up the
+// request that noticed it. load is expected to Set the key on success.
+func (s *server) refreshInBackground(cache *ttlLRUCache, cacheKey string, load func(context.Context) error) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshTimeout)
+		defer cancel()
+
+		if err := load(ctx); err != nil {
+			log.Printf("background refresh failed key=%s: %v", cacheKey, err)
+			cache.ReleaseRefresh(cacheKey)
+		}
+	}()
 }
 
 func (s *server) fetchItemsConcurrently(ctx context.Context, ids []int) ([]*hnItem, error) {
@@ -711,24 +1378,66 @@ func (s *server) fetchItemsConcurrently(ctx context.Context, ids []int) ([]*hnIt
 	}
 }
 
-func (s *server) fetchCommentForest(ctx context.Context, ids []int) ([]*commentResponse, error) {
+// commentWalk is the state shared by one hydration of a comment forest.
+type commentWalk struct {
+	sem chan struct{}
+	// maxDepth is how many levels are expanded, counting the roots; deeper
+	// replies are left as IDs. Zero means the whole tree.
+	maxDepth int
+	// parent is the ID the roots reply to, and offset the position of the
+	// first root among its siblings.
+	parent int
+	offset int
+	// emit, when set, is handed each comment as soon as it is fetched and
+	// before any of its replies, with its position among its siblings and
+	// its depth, 1 for the roots. Calls come from many goroutines at once.
+	emit func(node *commentResponse, parent int, position int, depth int)
+
+	mu     sync.Mutex
+	failed []int
+}
+
+// placeholder records that comment id could not be fetched and returns the
+// node that stands in for it and its unknown replies.
+func (walk *commentWalk) placeholder(id int, parent int, position int, depth int, err error) *commentResponse {
+	log.Printf("comment fetch failed id=%d: %v", id, err)
+	walk.mu.Lock()
+	walk.failed = append(walk.failed, id)
+	walk.mu.Unlock()
+
+	node := &commentResponse{ID: id, Type: "comment", Kids: []*commentResponse{}, Failed: true}
+	if walk.emit != nil {
+		walk.emit(node, parent, position, depth)
+	}
+	return node
+}
+
+// failures returns the IDs of the comments that could not be fetched, in
+// ascending order.
+func (walk *commentWalk) failures() []int {
+	walk.mu.Lock()
+	defer walk.mu.Unlock()
+	failed := append([]int(nil), walk.failed...)
+	sort.Ints(failed)
+	return failed
+}
+
+func (s *server) fetchCommentForest(ctx context.Context, ids []int, walk *commentWalk) ([]*commentResponse, error) {
 	if len(ids) == 0 {
 		return []*commentResponse{}, nil
 	}
 
 	results := make([]*commentResponse, len(ids))
-	sem := make(chan struct{}, maxConcurrentFetch)
+	walk.sem = make(chan struct{}, maxConcurrentFetch)
 
 	var wg sync.WaitGroup
 	for i, id := range ids {
 		wg.Add(1)
 		go func(idx, commentID int) {
 			defer wg.Done()
-			node, err := s.fetchCommentNode(ctx, commentID, sem)
+			node, err := s.fetchCommentNode(ctx, walk, commentID, walk.offset+idx, 1)
 			if err != nil {
-				log.Printf("comment fetch failed id=%d: %v", commentID, err)
-				// Non-fatal: leave results[idx] as nil, compactComments will skip it
-				return
+				node = walk.placeholder(commentID, walk.parent, walk.offset+idx, 1, err)
 			}
 			results[idx] = node
 		}(i, id)
@@ -738,14 +1447,17 @@ func (s *server) fetchCommentForest(ctx context.Context, ids []int) ([]*commentR
 	return compactComments(results), nil
 }
 
-func (s *server) fetchCommentNode(ctx context.Context, id int, sem chan struct{}) (*commentResponse, error) {
+// fetchCommentNode hydrates comment id, which is reply number position of
+// its parent and sits depth levels below the listing parent, and its replies
+// down to walk.maxDepth.
+func (s *server) fetchCommentNode(ctx context.Context, walk *commentWalk, id int, position int, depth int) (*commentResponse, error) {
 	select {
-	case sem <- struct{}{}:
+	case walk.sem <- struct{}{}:
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 	item, err := s.fetchItem(ctx, id)
-	<-sem
+	<-walk.sem
 	if err != nil {
 		return nil, err
 	}
@@ -754,7 +1466,14 @@ func (s *server) fetchCommentNode(ctx context.Context, id int, sem chan struct{}
 	}
 
 	node := toCommentResponse(item)
-	if len(item.Kids) == 0 {
+	if walk.maxDepth > 0 && depth >= walk.maxDepth && len(item.Kids) > 0 {
+		node.MoreKids = append([]int(nil), item.Kids...)
+	}
+	if walk.emit != nil {
+		walk.emit(node, item.Parent, position, depth)
+	}
+	if len(item.Kids) == 0 || node.MoreKids != nil {
+		node.summarize()
 		return node, nil
 	}
 
@@ -764,11 +1483,9 @@ func (s *server) fetchCommentNode(ctx context.Context, id int, sem chan struct{}
 		wg.Add(1)
 		go func(idx, cid int) {
 			defer wg.Done()
-			child, childErr := s.fetchCommentNode(ctx, cid, sem)
+			child, childErr := s.fetchCommentNode(ctx, walk, cid, idx, depth+1)
 			if childErr != nil {
-				log.Printf("child comment fetch failed id=%d: %v", cid, childErr)
-				// Non-fatal: leave children[idx] as nil
-				return
+				child = walk.placeholder(cid, item.ID, idx, depth+1, childErr)
 			}
 			children[idx] = child
 		}(i, childID)
@@ -776,6 +1493,7 @@ func (s *server) fetchCommentNode(ctx context.Context, id int, sem chan struct{}
 	wg.Wait()
 
 	node.Kids = compactComments(children)
+	node.summarize()
 	return node, nil
 }
 
@@ -806,19 +1524,24 @@ func (s *server) fetchFirebaseJSON(ctx context.Context, path string, dst any) er
 }
 
 func (s *server) prewarm(ctx context.Context) {
-	feeds := []string{"best", "top", "new"}
-	for _, feed := range feeds {
+	for _, feed := range feedRegistry {
+		if !feed.prewarm {
+			continue
+		}
 		feed := feed
 		go func() {
 			warmCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
 			defer cancel()
 
-			stories, err := s.getStoriesPage(warmCtx, feed, 0, defaultStoriesLimit)
+			stories, err := s.getStoriesPage(warmCtx, feed.name, 0, defaultStoriesLimit)
 			if err != nil {
-				log.Printf("cache prewarm failed for feed=%s: %v", feed, err)
+				log.Printf("cache prewarm failed for feed=%s: %v", feed.name, err)
 				return
 			}
-			log.Printf("cache prewarm complete for feed=%s count=%d", feed, len(stories))
+			log.Printf("cache prewarm complete for feed=%s count=%d", feed.name, len(stories))
+			if feed.prewarmReader {
+				s.prewarmReader(ctx, feed.name, stories)
+			}
 		}()
 	}
 }
@@ -831,6 +1554,23 @@ func parseID(raw string) (int, bool) {
 	return id, true
 }
 
+// parseUsername accepts HN account names: letters, digits, dashes and
+// underscores, at most 32 characters.
+func parseUsername(raw string) (string, bool) {
+	username := strings.TrimSpace(raw)
+	if username == "" || len(username) > 32 {
+		return "", false
+	}
+	for _, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return "", false
+		}
+	}
+	return username, true
+}
+
 func toStoryResponse(item *hnItem) storyResponse {
 	kids := append([]int(nil), item.Kids...)
 	if kids == nil {
@@ -876,14 +1616,15 @@ func toItemResponse(item *hnItem) itemResponse {
 
 func toCommentResponse(item *hnItem) *commentResponse {
 	return &commentResponse{
-		ID:      item.ID,
-		By:      item.By,
-		Time:    item.Time,
-		Text:    item.Text,
-		Kids:    []*commentResponse{},
-		Type:    item.Type,
-		Deleted: item.Deleted,
-		Dead:    item.Dead,
+		ID:       item.ID,
+		By:       item.By,
+		Time:     item.Time,
+		Text:     item.Text,
+		Kids:     []*commentResponse{},
+		Type:     item.Type,
+		Deleted:  item.Deleted,
+		Dead:     item.Dead,
+		KidCount: len(item.Kids),
 	}
 }
 
@@ -929,6 +1670,15 @@ func cloneItem(item *hnItem) *hnItem {
 	return &copied
 }
 
+func cloneUser(user *hnUser) *hnUser {
+	if user == nil {
+		return nil
+	}
+	copied := *user
+	copied.Submitted = append([]int(nil), user.Submitted...)
+	return &copied
+}
+
 func compactComments(nodes []*commentResponse) []*commentResponse {
 	compacted := make([]*commentResponse, 0, len(nodes))
 	for _, node := range nodes {
@@ -956,7 +1706,7 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 	}
 }
 
-func writeJSONCached(w http.ResponseWriter, status int, payload any, maxAge time.Duration, swr time.Duration) {
+func writeJSONCached(w http.ResponseWriter, r *http.Request, status int, payload any, maxAge time.Duration, swr time.Duration) {
 	if maxAge > 0 {
 		cc := fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
 		if swr > 0 {
@@ -964,7 +1714,57 @@ func writeJSONCached(w http.ResponseWriter, status int, payload any, maxAge time
 		}
 		w.Header().Set("Cache-Control", cc)
 	}
-	writeJSON(w, status, payload)
+	writeJSONConditional(w, r, status, payload)
+}
+
+// writeJSONConditional tags the encoded payload with a strong ETag and answers
+// a matching If-None-Match with 304 Not Modified instead of the body.
+func writeJSONConditional(w http.ResponseWriter, r *http.Request, status int, payload any) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(payload); err != nil {
+		log.Printf("response encode failed: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	writeBodyConditional(w, r, status, jsonContentType, body.Bytes())
+}
+
+// writeBodyConditional is writeJSONConditional for an already rendered body.
+func writeBodyConditional(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set(etagHeader, etag)
+	if status == http.StatusOK && etagMatches(r.Header.Get(ifNoneMatchHeader), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, contentType)
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("response write failed: %v", err)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag
+// using the weak comparison RFC 9110 prescribes for that header.
+func etagMatches(header string, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -980,10 +1780,14 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// gzipResponseWriter compresses the body and suffixes any ETag so the
+// compressed representation gets its own validator. Responses that cannot
+// carry a body (204, 304) are passed through untouched.
 type gzipResponseWriter struct {
 	http.ResponseWriter
 	writer      *gzip.Writer
 	wroteHeader bool
+	passthrough bool
 }
 
 func (g *gzipResponseWriter) WriteHeader(statusCode int) {
@@ -991,9 +1795,23 @@ func (g *gzipResponseWriter) WriteHeader(statusCode int) {
 		return
 	}
 	g.wroteHeader = true
+	// Images are already compressed; gzip would only cost CPU.
+	if strings.HasPrefix(g.Header().Get(contentTypeHeader), "image/") {
+		g.passthrough = true
+		g.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if etag := g.Header().Get(etagHeader); etag != "" && !strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		g.Header().Set(etagHeader, strings.TrimSuffix(etag, `"`)+gzipETagSuffix+`"`)
+	}
+	g.Header().Add(varyHeader, acceptEncoding)
+	if statusCode == http.StatusNotModified || statusCode == http.StatusNoContent {
+		g.passthrough = true
+		g.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
 	g.Header().Del("Content-Length")
 	g.Header().Set(contentEncoding, gzipEncoding)
-	g.Header().Add(varyHeader, acceptEncoding)
 	g.ResponseWriter.WriteHeader(statusCode)
 }
 
@@ -1001,19 +1819,33 @@ func (g *gzipResponseWriter) Write(data []byte) (int, error) {
 	if !g.wroteHeader {
 		g.WriteHeader(http.StatusOK)
 	}
+	if g.passthrough {
+		return g.ResponseWriter.Write(data)
+	}
 	if g.Header().Get(contentTypeHeader) == "" {
 		g.Header().Set(contentTypeHeader, http.DetectContentType(data))
 	}
 	return g.writer.Write(data)
 }
 
+// Flush pushes buffered compressed bytes to the client. Headers are committed
+// first so the gzip header never reaches the wire ahead of Content-Encoding.
 func (g *gzipResponseWriter) Flush() {
-	_ = g.writer.Flush()
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.passthrough {
+		_ = g.writer.Flush()
+	}
 	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
 }
 
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
 var gzipWriterPool = sync.Pool{
 	New: func() any {
 		w, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
@@ -1032,17 +1864,26 @@ func gzipMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Validators handed out by this middleware carry the gzip suffix; strip
+		// it so handlers compare against the tag of the uncompressed payload.
+		if inm := r.Header.Get(ifNoneMatchHeader); inm != "" {
+			r.Header.Set(ifNoneMatchHeader, strings.ReplaceAll(inm, gzipETagSuffix+`"`, `"`))
+		}
+
 		gz := gzipWriterPool.Get().(*gzip.Writer)
 		gz.Reset(w)
+		gw := &gzipResponseWriter{
+			ResponseWriter: w,
+			writer:         gz,
+		}
 		defer func() {
-			_ = gz.Close()
+			if !gw.passthrough {
+				_ = gz.Close()
+			}
 			gzipWriterPool.Put(gz)
 		}()
 
-		next.ServeHTTP(&gzipResponseWriter{
-			ResponseWriter: w,
-			writer:         gz,
-		}, r)
+		next.ServeHTTP(gw, r)
 	})
 }
 
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizedCacheEvictsByBytes(t *testing.T) {
+	c := newSizedTTLRUCache(100, 3000, readerCacheSize)
+	article := func(n int) *readerResponse {
+		return &readerResponse{Content: strings.Repeat("x", n)}
+	}
+
+	c.Set("reader:a", article(1000), time.Minute)
+	c.Set("reader:b", article(1000), time.Minute)
+	if _, ok := c.Get("reader:a"); !ok {
+		t.Fatal("reader:a evicted while under budget")
+	}
+	c.Set("reader:c", article(1000), time.Minute)
+	if c.Contains("reader:b") {
+		t.Fatal("least recently used reader:b survived going over budget")
+	}
+	if !c.Contains("reader:a") || !c.Contains("reader:c") {
+		t.Fatal("recent entries were evicted")
+	}
+	if stats := c.Stats(); stats.Bytes > 3000 {
+		t.Fatalf("resident bytes = %d, want at most 3000", stats.Bytes)
+	}
+
+	c.Set("reader:huge", article(5000), time.Minute)
+	if c.Contains("reader:huge") {
+		t.Fatal("value larger than the whole budget was cached")
+	}
+	c.Delete("reader:a")
+	c.Delete("reader:c")
+	if stats := c.Stats(); stats.Bytes != 0 || stats.Entries != 0 {
+		t.Fatalf("after deleting everything stats = %+v", stats)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"*", true},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", W/"abc"`, true},
+		{`"xyz"`, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestConditionalGzipResponses(t *testing.T) {
+	payload := map[string]string{"message": strings.Repeat("hello ", 50)}
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONConditional(w, r, http.StatusOK, payload)
+	}))
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := get(nil)
+	plainTag := plain.Header().Get(etagHeader)
+	if plain.Code != http.StatusOK || plainTag == "" || plain.Header().Get(contentEncoding) != "" {
+		t.Fatalf("plain response = %d etag %q encoding %q", plain.Code, plainTag, plain.Header().Get(contentEncoding))
+	}
+	if rec := get(map[string]string{ifNoneMatchHeader: plainTag}); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("revalidating the plain tag = %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := get(map[string]string{ifNoneMatchHeader: "W/" + plainTag}); rec.Code != http.StatusNotModified {
+		t.Errorf("revalidating a weak plain tag = %d", rec.Code)
+	}
+	if rec := get(map[string]string{ifNoneMatchHeader: `"stale"`}); rec.Code != http.StatusOK {
+		t.Errorf("a stale tag = %d, want 200", rec.Code)
+	}
+
+	gzipped := get(map[string]string{acceptEncoding: gzipEncoding})
+	gzipTag := gzipped.Header().Get(etagHeader)
+	if gzipped.Code != http.StatusOK || gzipped.Header().Get(contentEncoding) != gzipEncoding {
+		t.Fatalf("gzip response = %d encoding %q", gzipped.Code, gzipped.Header().Get(contentEncoding))
+	}
+	if want := strings.TrimSuffix(plainTag, `"`) + gzipETagSuffix + `"`; gzipTag != want {
+		t.Fatalf("gzip etag = %q, want %q", gzipTag, want)
+	}
+	if vary := gzipped.Header().Get(varyHeader); vary != acceptEncoding {
+		t.Errorf("vary = %q", vary)
+	}
+	zr, err := gzip.NewReader(gzipped.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(zr); err != nil || !strings.Contains(string(body), "hello hello") {
+		t.Fatalf("decompressed body = %q, %v", body, err)
+	}
+
+	for _, tag := range []string{gzipTag, "W/" + gzipTag} {
+		rec := get(map[string]string{acceptEncoding: gzipEncoding, ifNoneMatchHeader: tag})
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get(contentEncoding) != "" {
+			t.Errorf("revalidating %s = %d with %d bytes, encoding %q", tag, rec.Code, rec.Body.Len(), rec.Header().Get(contentEncoding))
+		}
+		if got := rec.Header().Get(etagHeader); got != gzipTag {
+			t.Errorf("304 etag = %q, want %q", got, gzipTag)
+		}
+	}
+}
+
+func TestGzipPassthrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		body    string
+	}{
+		{
+			name: "no content",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name: "image",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(contentTypeHeader, "image/png")
+				w.Write([]byte("\x89PNG"))
+			},
+			status: http.StatusOK,
+			body:   "\x89PNG",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(acceptEncoding, gzipEncoding)
+			rec := httptest.NewRecorder()
+			gzipMiddleware(tt.handler).ServeHTTP(rec, req)
+			if rec.Code != tt.status || rec.Header().Get(contentEncoding) != "" || rec.Body.String() != tt.body {
+				t.Errorf("got %d encoding %q body %q", rec.Code, rec.Header().Get(contentEncoding), rec.Body.String())
+			}
+		})
+	}
+}
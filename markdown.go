@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	markdownContentType  = "text/markdown; charset=utf-8"
+	plainTextContentType = "text/plain; charset=utf-8"
+	plainTextWidth       = 78
+	// plainTextMinWidth is the narrowest column text is wrapped to, however
+	// deeply quotes and lists nest.
+	plainTextMinWidth = 20
+)
+
+// articleRenderer converts readability's extracted HTML into Markdown or
+// wrapped plain text. Both modes share the block walker; plain text collects
+// link and image targets into a numbered reference list instead of inlining
+// them.
+type articleRenderer struct {
+	plain bool
+	links []string
+}
+
+// renderArticleMarkdown returns the article as a Markdown document headed by
+// its title, byline and source URL.
+func renderArticleMarkdown(article *readerResponse) (string, error) {
+	root, err := parseArticleHTML(article.Content)
+	if err != nil {
+		return "", err
+	}
+
+	r := &articleRenderer{}
+	var doc []string
+	if article.Title != "" {
+		doc = append(doc, "# "+escapeMarkdown(collapseSpace(article.Title)))
+	}
+	var meta []string
+	if article.Byline != "" {
+		meta = append(meta, "_"+escapeMarkdown(collapseSpace(article.Byline))+"_")
+	}
+	meta = append(meta, "Source: <"+article.FinalURL+">")
+	doc = append(doc, strings.Join(meta, "  \n"))
+	doc = append(doc, r.blocks(root, 0)...)
+	return strings.Join(doc, "\n\n") + "\n", nil
+}
+
+// renderArticleText returns the article as plain text wrapped at
+// plainTextWidth, followed by the numbered list of links it references.
+func renderArticleText(article *readerResponse) (string, error) {
+	root, err := parseArticleHTML(article.Content)
+	if err != nil {
+		return "", err
+	}
+
+	r := &articleRenderer{plain: true}
+	var doc []string
+	if title := collapseSpace(article.Title); title != "" {
+		doc = append(doc, title+"\n"+strings.Repeat("=", utf8.RuneCountInString(title)))
+	}
+	if byline := collapseSpace(article.Byline); byline != "" {
+		doc = append(doc, wrapText("By "+byline, plainTextWidth))
+	}
+	doc = append(doc, "Source: "+article.FinalURL)
+	doc = append(doc, r.blocks(root, plainTextWidth)...)
+	if len(r.links) > 0 {
+		refs := make([]string, 0, len(r.links)+1)
+		refs = append(refs, "Links:")
+		for i, link := range r.links {
+			refs = append(refs, fmt.Sprintf("[%d] %s", i+1, link))
+		}
+		doc = append(doc, strings.Join(refs, "\n"))
+	}
+	return strings.Join(doc, "\n\n") + "\n", nil
+}
+
+func parseArticleHTML(content string) (*html.Node, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(content), body)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		body.AppendChild(node)
+	}
+	return body, nil
+}
+
+// blocks renders the children of n as a list of blocks to be separated by
+// blank lines. width is the wrap column in plain mode and ignored otherwise.
+func (r *articleRenderer) blocks(n *html.Node, width int) []string {
+	var out []string
+	var inline strings.Builder
+	flush := func() {
+		if text := strings.TrimSpace(collapseSpace(inline.String())); text != "" {
+			out = append(out, r.paragraph(text, width))
+		}
+		inline.Reset()
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || !isBlockElement(c.DataAtom) {
+			inline.WriteString(r.inline(c))
+			continue
+		}
+		flush()
+		out = append(out, r.block(c, width)...)
+	}
+	flush()
+	return out
+}
+
+func (r *articleRenderer) paragraph(text string, width int) string {
+	if r.plain {
+		return wrapText(text, width)
+	}
+	return escapeLineStart(text)
+}
+
+func (r *articleRenderer) block(n *html.Node, width int) []string {
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Noscript, atom.Template, atom.Iframe, atom.Form, atom.Button:
+		return nil
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		text := strings.TrimSpace(collapseSpace(r.inlineChildren(n)))
+		if text == "" {
+			return nil
+		}
+		level := int(n.Data[1] - '0')
+		if r.plain {
+			underline := "-"
+			if level <= 2 {
+				underline = "="
+			}
+			return []string{text + "\n" + strings.Repeat(underline, min(utf8.RuneCountInString(text), width))}
+		}
+		return []string{strings.Repeat("#", level) + " " + text}
+	case atom.P:
+		text := strings.TrimSpace(collapseSpace(r.inlineChildren(n)))
+		if text == "" {
+			return nil
+		}
+		return []string{r.paragraph(text, width)}
+	case atom.Pre:
+		return []string{r.codeBlock(n)}
+	case atom.Blockquote:
+		inner := strings.Join(r.blocks(n, nestedWidth(width, 2)), "\n\n")
+		if inner == "" {
+			return nil
+		}
+		return []string{prefixLines(inner, "> ", "> ")}
+	case atom.Ul, atom.Ol:
+		return r.list(n, width)
+	case atom.Hr:
+		if r.plain {
+			return []string{strings.Repeat("-", min(20, width))}
+		}
+		return []string{"---"}
+	case atom.Table:
+		return r.table(n, width)
+	default:
+		return r.blocks(n, width)
+	}
+}
+
+// nestedWidth is the wrap column left inside a quote or list item whose
+// prefix takes indent columns.
+func nestedWidth(width int, indent int) int {
+	return max(width-indent, plainTextMinWidth)
+}
+
+func (r *articleRenderer) list(n *html.Node, width int) []string {
+	ordered := n.DataAtom == atom.Ol
+	index := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil && ordered {
+		index = start
+	}
+
+	var items []string
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if r.plain {
+			marker = "* "
+		}
+		if ordered {
+			marker = strconv.Itoa(index) + ". "
+			index++
+		}
+		indent := strings.Repeat(" ", len(marker))
+		body := strings.Join(r.blocks(li, nestedWidth(width, len(marker))), "\n\n")
+		if body == "" {
+			continue
+		}
+		items = append(items, prefixLines(body, marker, indent))
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	return []string{strings.Join(items, "\n")}
+}
+
+func (r *articleRenderer) codeBlock(n *html.Node) string {
+	code := strings.TrimRight(textContent(n), "\n")
+	if r.plain {
+		return prefixLines(code, "    ", "    ")
+	}
+
+	lang := ""
+	for _, node := range []*html.Node{n, n.FirstChild} {
+		if node == nil || node.Type != html.ElementNode {
+			continue
+		}
+		for _, class := range strings.Fields(attr(node, "class")) {
+			if after, ok := strings.CutPrefix(class, "language-"); ok {
+				lang = after
+			} else if after, ok := strings.CutPrefix(class, "lang-"); ok {
+				lang = after
+			}
+		}
+	}
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + code + "\n" + fence
+}
+
+func (r *articleRenderer) table(n *html.Node, width int) []string {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				walk(c)
+				continue
+			}
+			var row []string
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					text := strings.TrimSpace(collapseSpace(r.inlineChildren(cell)))
+					if !r.plain {
+						text = strings.ReplaceAll(text, "|", `\|`)
+					}
+					row = append(row, text)
+				}
+			}
+			if len(row) > 0 {
+				rows = append(rows, row)
+			}
+		}
+	}
+	walk(n)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if r.plain {
+		lines := make([]string, 0, len(rows))
+		for _, row := range rows {
+			lines = append(lines, wrapText(strings.Join(row, " | "), width))
+		}
+		return []string{strings.Join(lines, "\n")}
+	}
+
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+	return []string{strings.Join(lines, "\n")}
+}
+
+func (r *articleRenderer) inlineChildren(n *html.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(r.inline(c))
+	}
+	return b.String()
+}
+
+func (r *articleRenderer) inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		if r.plain {
+			return n.Data
+		}
+		return escapeMarkdown(n.Data)
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Noscript, atom.Template:
+		return ""
+	case atom.Br:
+		if r.plain {
+			return " "
+		}
+		return "  \n"
+	case atom.A:
+		text := strings.TrimSpace(collapseSpace(r.inlineChildren(n)))
+		href := strings.TrimSpace(attr(n, "href"))
+		if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			return text
+		}
+		if r.plain {
+			return text + " " + r.reference(href)
+		}
+		if text == "" {
+			return "<" + href + ">"
+		}
+		return "[" + text + "](" + markdownURL(href) + ")"
+	case atom.Img:
+		src := originalImageURL(strings.TrimSpace(attr(n, "src")))
+		if src == "" {
+			return ""
+		}
+		alt := collapseSpace(attr(n, "alt"))
+		if r.plain {
+			label := "[image]"
+			if alt != "" {
+				label = "[image: " + alt + "]"
+			}
+			return " " + label + " " + r.reference(src) + " "
+		}
+		return "![" + escapeMarkdown(alt) + "](" + markdownURL(src) + ")"
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		code := collapseSpace(textContent(n))
+		if r.plain || code == "" {
+			return code
+		}
+		fence := "`"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+			code = " " + code + " "
+		}
+		return fence + code + fence
+	case atom.Strong, atom.B:
+		return r.wrapInline(n, "**")
+	case atom.Em, atom.I, atom.Cite:
+		return r.wrapInline(n, "_")
+	case atom.Del, atom.S, atom.Strike:
+		return r.wrapInline(n, "~~")
+	}
+	if isBlockElement(n.DataAtom) {
+		// Block content nested inside inline markup is flattened.
+		return " " + r.inlineChildren(n) + " "
+	}
+	return r.inlineChildren(n)
+}
+
+// wrapInline surrounds an element's text with a Markdown delimiter, keeping
+// the surrounding whitespace outside it so the emphasis still parses.
+func (r *articleRenderer) wrapInline(n *html.Node, delim string) string {
+	text := r.inlineChildren(n)
+	if r.plain {
+		return text
+	}
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	return lead + delim + trimmed + delim + trail
+}
+
+func (r *articleRenderer) reference(target string) string {
+	for i, link := range r.links {
+		if link == target {
+			return "[" + strconv.Itoa(i+1) + "]"
+		}
+	}
+	r.links = append(r.links, target)
+	return "[" + strconv.Itoa(len(r.links)) + "]"
+}
+
+func isBlockElement(a atom.Atom) bool {
+	switch a {
+	case atom.Address, atom.Article, atom.Aside, atom.Blockquote, atom.Details, atom.Dialog,
+		atom.Dd, atom.Div, atom.Dl, atom.Dt, atom.Fieldset, atom.Figcaption, atom.Figure,
+		atom.Footer, atom.Form, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Header, atom.Hgroup, atom.Hr, atom.Li, atom.Main, atom.Nav, atom.Ol, atom.P,
+		atom.Pre, atom.Section, atom.Summary, atom.Table, atom.Ul, atom.Script, atom.Style,
+		atom.Noscript, atom.Template, atom.Iframe, atom.Button:
+		return true
+	}
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Br {
+			b.WriteByte('\n')
+			continue
+		}
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+// collapseSpace folds runs of whitespace into single spaces, keeping the
+// hard line breaks Markdown uses for <br>.
+func collapseSpace(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	space := false
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "  \n") {
+			b.WriteString("  \n")
+			i += 2
+			space = false
+			continue
+		}
+		switch s[i] {
+		case ' ', '\t', '\n', '\r', '\f':
+			space = true
+		default:
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteByte(s[i])
+		}
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`,
+)
+
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// escapeLineStart keeps paragraph text from being read as a heading, list
+// item or quote.
+func escapeLineStart(s string) string {
+	if s == "" {
+		return s
+	}
+	switch s[0] {
+	case '#', '+', '-', '=', '|':
+		return `\` + s
+	}
+	digits := 0
+	for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits < len(s) && (s[digits] == '.' || s[digits] == ')') {
+		return s[:digits] + `\` + s[digits:]
+	}
+	return s
+}
+
+func markdownURL(u string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(u)
+}
+
+func prefixLines(s string, first string, rest string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if line == "" {
+			lines[i] = strings.TrimRight(prefix, " ")
+			continue
+		}
+		lines[i] = prefix + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// wrapText breaks s into lines of at most width runes at word boundaries.
+// Words longer than width, such as URLs, get a line to themselves.
+func wrapText(s string, width int) string {
+	width = max(width, plainTextMinWidth)
+	var b strings.Builder
+	lineLen := 0
+	for _, word := range strings.Fields(s) {
+		wordLen := utf8.RuneCountInString(word)
+		if lineLen > 0 && lineLen+1+wordLen > width {
+			b.WriteByte('\n')
+			lineLen = 0
+		} else if lineLen > 0 {
+			b.WriteByte(' ')
+			lineLen++
+		}
+		b.WriteString(word)
+		lineLen += wordLen
+	}
+	return b.String()
+}
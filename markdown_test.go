@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestArticleRendererBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		markdown []string
+		text     []string
+		links    []string
+	}{
+		{
+			name:     "headings",
+			content:  `<h1>Title</h1><h2>Sub</h2><h3>Small <em>one</em></h3><h4> </h4>`,
+			markdown: []string{"# Title", "## Sub", "### Small _one_"},
+			text:     []string{"Title\n=====", "Sub\n===", "Small one\n---------"},
+		},
+		{
+			name:     "lists",
+			content:  `<ul><li>one</li><li>two<ul><li>nested</li></ul></li></ul><ol start="3"><li>three</li><li><p>four</p></li></ol>`,
+			markdown: []string{"- one\n- two\n\n  - nested", "3. three\n4. four"},
+			text:     []string{"* one\n* two\n\n  * nested", "3. three\n4. four"},
+		},
+		{
+			name:     "nested quotes",
+			content:  `<blockquote><p>outer</p><blockquote><p>inner</p></blockquote></blockquote>`,
+			markdown: []string{"> outer\n>\n> > inner"},
+			text:     []string{"> outer\n>\n> > inner"},
+		},
+		{
+			name:     "table",
+			content:  `<table><tr><th>A</th><th>B|C</th></tr><tr><td>1</td><td>2</td><td>3</td></tr></table>`,
+			markdown: []string{"| A | B\\|C |  |\n| --- | --- | --- |\n| 1 | 2 | 3 |"},
+			text:     []string{"A | B|C\n1 | 2 | 3"},
+		},
+		{
+			name:     "code",
+			content:  "<pre><code class=\"language-go\">x := 1\nfmt.Println(\"```\")</code></pre><p>Use <code>go test</code> now</p>",
+			markdown: []string{"````go\nx := 1\nfmt.Println(\"```\")\n````", "Use `go test` now"},
+			text:     []string{"    x := 1\n    fmt.Println(\"```\")", "Use go test now"},
+		},
+		{
+			name:     "links and images",
+			content:  `<p>See <a href="https://example.com/a b">the docs</a>, <a href="#x">here</a> and <a href="https://example.com/a b">again</a>. <img src="/api/image?url=https%3A%2F%2Fexample.com%2Fi.png" alt="Chart"></p>`,
+			markdown: []string{"See [the docs](https://example.com/a%20b), here and [again](https://example.com/a%20b). ![Chart](https://example.com/i.png)"},
+			text:     []string{"See the docs [1], here and again [1]. [image: Chart] [2]"},
+			links:    []string{"https://example.com/a b", "https://example.com/i.png"},
+		},
+		{
+			name:     "escapes",
+			content:  `<p>1. Not a list</p><p># not heading</p><p>a *b* [c]</p>`,
+			markdown: []string{"1\\. Not a list", "\\# not heading", "a \\*b\\* \\[c\\]"},
+			text:     []string{"1. Not a list", "# not heading", "a *b* [c]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseArticleHTML(tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (&articleRenderer{}).blocks(root, 0); !reflect.DeepEqual(got, tt.markdown) {
+				t.Errorf("markdown =\n%q\nwant\n%q", got, tt.markdown)
+			}
+			r := &articleRenderer{plain: true}
+			if got := r.blocks(root, plainTextWidth); !reflect.DeepEqual(got, tt.text) {
+				t.Errorf("text =\n%q\nwant\n%q", got, tt.text)
+			}
+			if !reflect.DeepEqual(r.links, tt.links) {
+				t.Errorf("links = %q, want %q", r.links, tt.links)
+			}
+		})
+	}
+}
+
+func TestRenderArticleText(t *testing.T) {
+	article := &readerResponse{
+		Title:    "A title",
+		Byline:   "Ann Author",
+		FinalURL: "https://example.com/post",
+		Content:  `<p>` + strings.Repeat("word ", 30) + `<a href="https://example.com/more">more</a></p>`,
+	}
+	got, err := renderArticleText(article)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A title\n=======\n\nBy Ann Author\n\nSource: https://example.com/post\n\n" +
+		strings.TrimSpace(strings.Repeat("word ", 15)) + "\n" + strings.TrimSpace(strings.Repeat("word ", 15)) + "\nmore [1]\n\n" +
+		"Links:\n[1] https://example.com/more\n"
+	if got != want {
+		t.Fatalf("text =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestRenderArticleDeepNesting checks that nesting deeper than the wrap
+// width allows still renders, with text wrapped to plainTextMinWidth.
+func TestRenderArticleDeepNesting(t *testing.T) {
+	for _, inner := range []string{"<h3>Deep heading</h3>", "<hr>", "<ul><li>" + strings.Repeat("item ", 20) + "</li></ul>"} {
+		content := strings.Repeat("<blockquote>", 45) + inner + strings.Repeat("</blockquote>", 45)
+		article := &readerResponse{FinalURL: "https://example.com/", Content: content}
+		if _, err := renderArticleMarkdown(article); err != nil {
+			t.Fatalf("%s: markdown: %v", inner, err)
+		}
+		text, err := renderArticleText(article)
+		if err != nil {
+			t.Fatalf("%s: text: %v", inner, err)
+		}
+		for _, line := range strings.Split(text, "\n") {
+			if !strings.HasPrefix(line, ">") {
+				continue
+			}
+			body := strings.TrimLeft(line, "> *")
+			if n := utf8.RuneCountInString(body); n > plainTextMinWidth {
+				t.Errorf("%s: line %q runs %d columns past its quotes", inner, line, n)
+			}
+		}
+	}
+}
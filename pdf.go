@@ -0,0 +1,1240 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	pdfContentType        = "application/pdf"
+	readerMaxPDFBytes     = 25_000_000
+	readerMaxPDFPages     = 300
+	readerMaxPDFTextBytes = 2_000_000
+	// readerMaxPDFDecodedBytes caps everything decompressed or assembled
+	// while reading one PDF, so a small file cannot expand without bound.
+	readerMaxPDFDecodedBytes = 64_000_000
+	pdfMaxStreamBytes        = 32_000_000
+	// pdfMaxStringBytes and pdfMaxArrayItems bound single objects, so an
+	// unterminated string or array cannot swallow the rest of the file.
+	pdfMaxStringBytes = 1 << 18
+	pdfMaxArrayItems  = 100_000
+	pdfExcerptRunes   = 280
+	// pdfWordGap is the TJ adjustment, in thousandths of an em, at or beyond
+	// which a gap is taken as a word space rather than kerning.
+	pdfWordGap = -180
+)
+
+var (
+	errPDFEncrypted = errors.New("pdf is encrypted")
+	errPDFMalformed = errors.New("pdf could not be parsed")
+	errPDFTooLarge  = errors.New("pdf decompresses past the size limit")
+	errPDFDeadline  = errors.New("pdf took too long to parse")
+)
+
+// documentInfo carries the metadata of non-HTML documents, currently PDFs,
+// alongside the usual reader fields.
+type documentInfo struct {
+	Type      string `json:"type"`
+	Pages     int    `json:"pages"`
+	Subject   string `json:"subject,omitempty"`
+	Keywords  string `json:"keywords,omitempty"`
+	Creator   string `json:"creator,omitempty"`
+	Producer  string `json:"producer,omitempty"`
+	Created   string `json:"created,omitempty"`
+	Modified  string `json:"modified,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// isPDFResponse reports whether a fetched document should take the PDF path:
+// it says so in Content-Type, or it is a generic binary whose URL ends in .pdf.
+func isPDFResponse(contentType string, finalURL *url.URL) bool {
+	if strings.Contains(contentType, pdfContentType) {
+		return true
+	}
+	return strings.Contains(contentType, "application/octet-stream") &&
+		strings.HasSuffix(strings.ToLower(finalURL.Path), ".pdf")
+}
+
+// extractPDFArticle turns a PDF into the readerResponse shape: the document
+// title and author from its Info dictionary, page text as paragraphs in
+// Content and TextContent, and the remaining metadata in Document. Parsing
+// gives up with errPDFDeadline once deadline passes; zero means no deadline.
+func extractPDFArticle(data []byte, target *url.URL, finalURL *url.URL, deadline time.Time) (article *readerResponse, err error) {
+	// The parser works on untrusted input; a bug in it should fail this PDF,
+	// not the server.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("pdf parser panicked url=%s: %v", target.String(), recovered)
+			article, err = nil, errPDFMalformed
+		}
+	}()
+
+	doc, err := parsePDF(data, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, total, truncated := doc.pageTexts()
+	if doc.expired() {
+		return nil, errPDFDeadline
+	}
+	var content strings.Builder
+	var text strings.Builder
+	firstLine := ""
+	for i, page := range pages {
+		paragraphs := pdfParagraphs(page)
+		if len(paragraphs) == 0 {
+			continue
+		}
+		if firstLine == "" {
+			firstLine = paragraphs[0]
+		}
+		fmt.Fprintf(&content, `<section data-page="%d">`, i+1)
+		for _, paragraph := range paragraphs {
+			content.WriteString("<p>")
+			content.WriteString(html.EscapeString(paragraph))
+			content.WriteString("</p>")
+			if text.Len() > 0 {
+				text.WriteString("\n\n")
+			}
+			text.WriteString(paragraph)
+		}
+		content.WriteString("</section>")
+	}
+	if text.Len() == 0 {
+		if doc.budget <= 0 {
+			return nil, errPDFTooLarge
+		}
+		return nil, &readerError{status: http.StatusUnprocessableEntity, message: "PDF has no extractable text"}
+	}
+
+	info := doc.info()
+	title := info["Title"]
+	if title == "" {
+		title = truncateRunes(firstLine, 200)
+	}
+	body := text.String()
+	return &readerResponse{
+		URL:         target.String(),
+		FinalURL:    finalURL.String(),
+		Title:       title,
+		Byline:      info["Author"],
+		SiteName:    extractDomain(finalURL.String()),
+		Excerpt:     truncateRunes(body, pdfExcerptRunes),
+		Content:     `<div id="readability-page-1" class="page">` + content.String() + `</div>`,
+		TextContent: body,
+		Length:      utf8.RuneCountInString(body),
+		Document: &documentInfo{
+			Type:      "pdf",
+			Pages:     total,
+			Subject:   info["Subject"],
+			Keywords:  info["Keywords"],
+			Creator:   info["Creator"],
+			Producer:  info["Producer"],
+			Created:   parsePDFDate(info["CreationDate"]),
+			Modified:  parsePDFDate(info["ModDate"]),
+			Truncated: truncated,
+		},
+	}, nil
+}
+
+func truncateRunes(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	runes := []rune(s)
+	cut := strings.TrimRightFunc(string(runes[:limit]), unicode.IsSpace)
+	if idx := strings.LastIndexFunc(cut, unicode.IsSpace); idx > len(cut)/2 {
+		cut = cut[:idx]
+	}
+	return cut + "…"
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// pdfParagraphs joins a page's text lines into paragraphs. A line that is
+// noticeably shorter than the page's typical line and ends a sentence closes
+// its paragraph; words hyphenated across lines are rejoined.
+func pdfParagraphs(page string) []string {
+	var lines []string
+	for _, line := range strings.Split(page, "\n") {
+		if line = strings.TrimSpace(collapseSpace(line)); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	lengths := make([]int, len(lines))
+	for i, line := range lines {
+		lengths[i] = utf8.RuneCountInString(line)
+	}
+	sorted := append([]int(nil), lengths...)
+	sort.Ints(sorted)
+	typical := sorted[len(sorted)*3/4]
+
+	var paragraphs []string
+	var current strings.Builder
+	for i, line := range lines {
+		if current.Len() > 0 {
+			prev := current.String()
+			if strings.HasSuffix(prev, "-") && startsLower(line) {
+				current.Reset()
+				current.WriteString(strings.TrimSuffix(prev, "-"))
+			} else {
+				current.WriteByte(' ')
+			}
+		}
+		current.WriteString(line)
+
+		short := float64(lengths[i]) < 0.7*float64(typical)
+		if short && (endsSentence(line) || i+1 < len(lines) && !startsLower(lines[i+1])) {
+			paragraphs = append(paragraphs, current.String())
+			current.Reset()
+		}
+	}
+	if current.Len() > 0 {
+		paragraphs = append(paragraphs, current.String())
+	}
+	return paragraphs
+}
+
+func startsLower(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLower(r)
+}
+
+func endsSentence(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return strings.ContainsRune(".?!:\"”)", r)
+}
+
+// parsePDFDate converts a PDF date string (D:YYYYMMDDHHmmSSOHH'mm') to
+// RFC 3339, returning the input unchanged if it does not parse.
+func parsePDFDate(raw string) string {
+	s := strings.TrimPrefix(strings.TrimSpace(raw), "D:")
+	if len(s) < 4 {
+		return raw
+	}
+	layouts := []string{"20060102150405Z07'00'", "20060102150405Z07'00", "20060102150405Z0700", "20060102150405Z", "20060102150405", "200601021504", "2006010215", "20060102", "200601", "2006"}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return raw
+}
+
+// PDF object model. Numbers are float64, names pdfName, strings []byte via
+// pdfString, arrays []any and dictionaries pdfDict.
+type (
+	pdfName    string
+	pdfKeyword string
+	pdfString  []byte
+	pdfDict    map[string]any
+	pdfRef     struct{ num, gen int }
+	pdfStream  struct {
+		dict pdfDict
+		raw  []byte
+	}
+)
+
+type pdfDocument struct {
+	objects map[int]any
+	trailer pdfDict
+	// budget is what remains of readerMaxPDFDecodedBytes. decoded and fonts
+	// memoize work shared between pages so it is only paid for once.
+	budget  int
+	decoded map[*pdfStream][]byte
+	fonts   map[pdfRef]*pdfFont
+	// deadline, when set, is when parsing and extraction give up.
+	deadline time.Time
+}
+
+func (d *pdfDocument) expired() bool {
+	return !d.deadline.IsZero() && time.Now().After(d.deadline)
+}
+
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// parsePDF indexes every object in data by scanning for "N G obj" headers
+// rather than trusting the cross-reference table, which is often damaged;
+// later definitions win, as incremental updates intend. Objects packed into
+// object streams are unpacked afterwards.
+func parsePDF(data []byte, deadline time.Time) (*pdfDocument, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data[:min(len(data), 1024)], "\x00\t\r\n "), []byte("%PDF-")) {
+		return nil, errPDFMalformed
+	}
+
+	doc := &pdfDocument{
+		objects:  make(map[int]any),
+		budget:   readerMaxPDFDecodedBytes,
+		decoded:  make(map[*pdfStream][]byte),
+		fonts:    make(map[pdfRef]*pdfFont),
+		deadline: deadline,
+	}
+	skipUntil := 0
+	for _, match := range pdfObjectHeader.FindAllSubmatchIndex(data, -1) {
+		if match[0] < skipUntil {
+			continue
+		}
+		if doc.expired() {
+			return nil, errPDFDeadline
+		}
+		num, _ := strconv.Atoi(string(data[match[2]:match[3]]))
+		lex := &pdfLexer{data: data, pos: match[1]}
+		obj, err := lex.object()
+		// Headers inside whatever the object spanned, even one that failed
+		// to parse, are not lexed again; otherwise an unterminated string
+		// would be read to the end of the file from every header after it.
+		skipUntil = lex.pos
+		if err != nil {
+			continue
+		}
+		if dict, ok := obj.(pdfDict); ok {
+			if stream, end, ok := lex.streamAfter(dict); ok {
+				obj = stream
+				skipUntil = end
+			}
+		}
+		doc.objects[num] = obj
+	}
+
+	for _, obj := range doc.objects {
+		stream, ok := obj.(*pdfStream)
+		if !ok {
+			continue
+		}
+		if doc.expired() {
+			return nil, errPDFDeadline
+		}
+		switch stream.dict["Type"] {
+		case pdfName("ObjStm"):
+			doc.unpackObjectStream(stream)
+		case pdfName("XRef"):
+			if doc.trailer == nil || stream.dict["Root"] != nil {
+				doc.trailer = stream.dict
+			}
+		}
+	}
+	if idx := bytes.LastIndex(data, []byte("trailer")); idx >= 0 {
+		lex := &pdfLexer{data: data, pos: idx + len("trailer")}
+		if obj, err := lex.object(); err == nil {
+			if dict, ok := obj.(pdfDict); ok && dict["Root"] != nil {
+				doc.trailer = dict
+			}
+		}
+	}
+	if doc.trailer == nil {
+		return nil, errPDFMalformed
+	}
+	if doc.trailer["Encrypt"] != nil {
+		return nil, errPDFEncrypted
+	}
+	return doc, nil
+}
+
+func (d *pdfDocument) unpackObjectStream(stream *pdfStream) {
+	data, err := d.decodeStream(stream)
+	if err != nil {
+		return
+	}
+	count, _ := d.resolve(stream.dict["N"]).(float64)
+	first, _ := d.resolve(stream.dict["First"]).(float64)
+	if count <= 0 || first <= 0 || int(first) > len(data) {
+		return
+	}
+
+	header := &pdfLexer{data: data[:int(first)]}
+	for i := 0; i < int(count); i++ {
+		numObj, err1 := header.object()
+		offObj, err2 := header.object()
+		num, ok1 := numObj.(float64)
+		off, ok2 := offObj.(float64)
+		if err1 != nil || err2 != nil || !ok1 || !ok2 {
+			return
+		}
+		if _, exists := d.objects[int(num)]; exists {
+			continue
+		}
+		if off < 0 || off >= float64(len(data)-int(first)) {
+			continue
+		}
+		lex := &pdfLexer{data: data, pos: int(first) + int(off)}
+		if obj, err := lex.object(); err == nil {
+			d.objects[int(num)] = obj
+		}
+	}
+}
+
+func (d *pdfDocument) resolve(obj any) any {
+	for i := 0; i < 32; i++ {
+		ref, ok := obj.(pdfRef)
+		if !ok {
+			return obj
+		}
+		obj = d.objects[ref.num]
+	}
+	return nil
+}
+
+func (d *pdfDocument) dict(obj any) pdfDict {
+	switch v := d.resolve(obj).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+// charge takes n bytes from the document's decode budget, failing once it is
+// spent.
+func (d *pdfDocument) charge(n int) error {
+	if n > d.budget {
+		d.budget = 0
+		return errPDFTooLarge
+	}
+	d.budget -= n
+	return nil
+}
+
+// decodeStream applies the stream's filters. Only the filters that carry
+// text in practice are supported. Every decoded byte is charged to the
+// document's budget, and each stream is decoded at most once.
+func (d *pdfDocument) decodeStream(stream *pdfStream) ([]byte, error) {
+	if data, ok := d.decoded[stream]; ok {
+		return data, nil
+	}
+	data, err := d.applyFilters(stream)
+	if err != nil {
+		return nil, err
+	}
+	d.decoded[stream] = data
+	return data, nil
+}
+
+func (d *pdfDocument) applyFilters(stream *pdfStream) ([]byte, error) {
+	data := stream.raw
+	var filters []any
+	switch f := d.resolve(stream.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []any{f}
+	case []any:
+		filters = f
+	}
+	for _, filter := range filters {
+		name, _ := d.resolve(filter).(pdfName)
+		switch name {
+		case "FlateDecode", "Fl":
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			// Truncated deflate data is common; keep whatever decoded.
+			limit := min(pdfMaxStreamBytes, d.budget)
+			decoded, _ := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+			if len(decoded) > limit {
+				if limit < pdfMaxStreamBytes {
+					d.budget = 0
+					return nil, errPDFTooLarge
+				}
+				decoded = decoded[:limit]
+			}
+			data = decoded
+		case "ASCIIHexDecode", "AHx":
+			cleaned := bytes.Map(func(r rune) rune {
+				if unicode.IsSpace(r) || r == '>' {
+					return -1
+				}
+				return r
+			}, data)
+			if len(cleaned)%2 == 1 {
+				cleaned = append(cleaned, '0')
+			}
+			decoded := make([]byte, hex.DecodedLen(len(cleaned)))
+			if _, err := hex.Decode(decoded, cleaned); err != nil {
+				return nil, err
+			}
+			data = decoded
+		case "ASCII85Decode", "A85":
+			trimmed := bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+			if idx := bytes.Index(trimmed, []byte("~>")); idx >= 0 {
+				trimmed = trimmed[:idx]
+			}
+			decoded := make([]byte, len(trimmed))
+			n, _, err := ascii85.Decode(decoded, trimmed, true)
+			if err != nil {
+				return nil, err
+			}
+			data = decoded[:n]
+		default:
+			return nil, fmt.Errorf("unsupported pdf filter %s", name)
+		}
+		if err := d.charge(len(data)); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// info returns the Info dictionary's text entries.
+func (d *pdfDocument) info() map[string]string {
+	values := make(map[string]string)
+	for key, value := range d.dict(d.trailer["Info"]) {
+		if s, ok := d.resolve(value).(pdfString); ok {
+			if text := strings.TrimSpace(decodePDFTextString(s)); text != "" {
+				values[key] = text
+			}
+		}
+	}
+	return values
+}
+
+// pageTexts extracts the text of up to readerMaxPDFPages pages in document
+// order, stopping early once readerMaxPDFTextBytes have been collected. It
+// also returns the total page count and whether anything was left out.
+func (d *pdfDocument) pageTexts() ([]string, int, bool) {
+	root := d.dict(d.trailer["Root"])
+	var pages []string
+	total := 0
+	budget := readerMaxPDFTextBytes
+	truncated := false
+	visited := make(map[pdfRef]bool)
+
+	var walk func(node any, inherited pdfDict)
+	walk = func(node any, inherited pdfDict) {
+		if ref, ok := node.(pdfRef); ok {
+			if visited[ref] {
+				return
+			}
+			visited[ref] = true
+		}
+		dict := d.dict(node)
+		if dict == nil {
+			return
+		}
+		resources := inherited
+		if own := d.dict(dict["Resources"]); own != nil {
+			resources = own
+		}
+		if kids, ok := d.resolve(dict["Kids"]).([]any); ok {
+			for _, kid := range kids {
+				walk(kid, resources)
+			}
+			return
+		}
+
+		total++
+		if len(pages) >= readerMaxPDFPages || budget <= 0 || d.budget <= 0 || d.expired() {
+			truncated = true
+			return
+		}
+		text := d.pageText(dict, resources)
+		if len(text) > budget {
+			text = truncateUTF8(text, budget)
+			budget = len(text)
+			truncated = true
+		}
+		budget -= len(text)
+		pages = append(pages, text)
+	}
+	walk(root["Pages"], nil)
+	return pages, total, truncated
+}
+
+func (d *pdfDocument) pageText(page pdfDict, resources pdfDict) string {
+	var content []byte
+	switch c := d.resolve(page["Contents"]).(type) {
+	case *pdfStream:
+		content, _ = d.decodeStream(c)
+	case []any:
+		for _, part := range c {
+			stream, ok := d.resolve(part).(*pdfStream)
+			if !ok {
+				continue
+			}
+			decoded, err := d.decodeStream(stream)
+			if errors.Is(err, errPDFTooLarge) {
+				break
+			}
+			// The same stream may be listed many times over; the joined copy
+			// is charged too.
+			if err != nil || d.charge(len(decoded)+1) != nil {
+				continue
+			}
+			content = append(content, decoded...)
+			content = append(content, '\n')
+		}
+	}
+	if len(content) == 0 {
+		return ""
+	}
+
+	fonts := make(map[string]*pdfFont)
+	fontDicts := d.dict(resources["Font"])
+	lookupFont := func(name pdfName) *pdfFont {
+		if font, ok := fonts[string(name)]; ok {
+			return font
+		}
+		ref, shared := fontDicts[string(name)].(pdfRef)
+		font, ok := d.fonts[ref]
+		if !shared || !ok {
+			font = d.loadFont(d.dict(fontDicts[string(name)]))
+		}
+		if shared {
+			d.fonts[ref] = font
+		}
+		fonts[string(name)] = font
+		return font
+	}
+
+	var out strings.Builder
+	newline := func() {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	space := func() {
+		if s := out.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\n") {
+			out.WriteByte(' ')
+		}
+	}
+
+	var font *pdfFont
+	show := func(s pdfString) {
+		out.WriteString(font.decode(s))
+	}
+	lastY := math.NaN()
+	lex := &pdfLexer{data: content}
+	var operands []any
+	for {
+		obj, err := lex.object()
+		if err != nil {
+			break
+		}
+		op, isOp := obj.(pdfKeyword)
+		if !isOp {
+			operands = append(operands, obj)
+			continue
+		}
+		switch op {
+		case "BI":
+			lex.skipInlineImage()
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[0].(pdfName); ok {
+					font = lookupFont(name)
+				}
+			}
+		case "Tj":
+			if len(operands) >= 1 {
+				if s, ok := operands[0].(pdfString); ok {
+					show(s)
+				}
+			}
+		case "'":
+			newline()
+			if len(operands) >= 1 {
+				if s, ok := operands[0].(pdfString); ok {
+					show(s)
+				}
+			}
+		case "\"":
+			newline()
+			if len(operands) >= 3 {
+				if s, ok := operands[2].(pdfString); ok {
+					show(s)
+				}
+			}
+		case "TJ":
+			if len(operands) >= 1 {
+				parts, _ := operands[0].([]any)
+				for _, part := range parts {
+					switch v := part.(type) {
+					case pdfString:
+						show(v)
+					case float64:
+						if v <= pdfWordGap {
+							space()
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				tx, _ := operands[0].(float64)
+				ty, _ := operands[1].(float64)
+				if ty != 0 {
+					newline()
+				} else if tx != 0 {
+					space()
+				}
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				y, _ := operands[5].(float64)
+				if !math.IsNaN(lastY) && y != lastY {
+					newline()
+				} else {
+					space()
+				}
+				lastY = y
+			}
+		case "T*":
+			newline()
+		case "ET":
+			space()
+		}
+		operands = operands[:0]
+	}
+	return out.String()
+}
+
+// pdfFont maps a font's character codes to text, through its ToUnicode CMap
+// when it has one and as windows-1252 otherwise.
+type pdfFont struct {
+	toUnicode map[string]string
+	widths    []int
+	// opaque fonts use multi-byte codes but have no ToUnicode map, so their
+	// text cannot be recovered.
+	opaque bool
+}
+
+func (d *pdfDocument) loadFont(dict pdfDict) *pdfFont {
+	font := &pdfFont{}
+	if dict == nil {
+		return font
+	}
+	if stream, ok := d.resolve(dict["ToUnicode"]).(*pdfStream); ok {
+		if data, err := d.decodeStream(stream); err == nil {
+			font.toUnicode, font.widths = parseToUnicode(data)
+		}
+	}
+	if font.toUnicode == nil {
+		subtype, _ := d.resolve(dict["Subtype"]).(pdfName)
+		font.opaque = subtype == "Type0"
+	}
+	return font
+}
+
+func (f *pdfFont) decode(s pdfString) string {
+	if f == nil || (f.toUnicode == nil && !f.opaque) {
+		text, _ := charmap.Windows1252.NewDecoder().Bytes(s)
+		return strings.Map(func(r rune) rune {
+			if r < ' ' && r != '\t' {
+				return -1
+			}
+			return r
+		}, string(text))
+	}
+	if f.opaque {
+		return ""
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		for _, width := range f.widths {
+			if i+width > len(s) {
+				continue
+			}
+			if text, ok := f.toUnicode[string(s[i:i+width])]; ok {
+				b.WriteString(text)
+				i += width
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			i += f.widths[0]
+		}
+	}
+	return b.String()
+}
+
+// parseToUnicode reads the bfchar and bfrange sections of a ToUnicode CMap.
+// It returns the code-to-text map and the code widths in use, shortest
+// first.
+func parseToUnicode(data []byte) (map[string]string, []int) {
+	mapping := make(map[string]string)
+	widthSet := make(map[int]bool)
+	lex := &pdfLexer{data: data}
+	var operands []any
+	const maxEntries = 100_000
+
+	for len(mapping) < maxEntries {
+		obj, err := lex.object()
+		if err != nil {
+			break
+		}
+		op, isOp := obj.(pdfKeyword)
+		if !isOp {
+			operands = append(operands, obj)
+			continue
+		}
+		switch op {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				if lo, ok := operands[i].(pdfString); ok && len(lo) > 0 {
+					widthSet[len(lo)] = true
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(pdfString)
+				dst, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 && len(src) > 0 {
+					mapping[string(src)] = decodeUTF16BE(dst)
+					widthSet[len(src)] = true
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(pdfString)
+				hi, ok2 := operands[i+1].(pdfString)
+				if !ok1 || !ok2 || len(lo) == 0 || len(lo) != len(hi) || len(lo) > 4 {
+					continue
+				}
+				widthSet[len(lo)] = true
+				start, end := codeValue(lo), codeValue(hi)
+				for code := start; code <= end && len(mapping) < maxEntries; code++ {
+					key := string(codeBytes(code, len(lo)))
+					switch dst := operands[i+2].(type) {
+					case pdfString:
+						runes := []rune(decodeUTF16BE(dst))
+						if len(runes) > 0 {
+							runes[len(runes)-1] += rune(code - start)
+						}
+						mapping[key] = string(runes)
+					case []any:
+						if idx := int(code - start); idx < len(dst) {
+							if s, ok := dst[idx].(pdfString); ok {
+								mapping[key] = decodeUTF16BE(s)
+							}
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+
+	if len(widthSet) == 0 {
+		return nil, nil
+	}
+	widths := make([]int, 0, len(widthSet))
+	for width := range widthSet {
+		widths = append(widths, width)
+	}
+	sort.Ints(widths)
+	return mapping, widths
+}
+
+func codeValue(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func codeBytes(v uint32, width int) []byte {
+	b := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return b
+}
+
+func decodeUTF16BE(b []byte) string {
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// decodePDFTextString decodes a string outside a content stream, which is
+// UTF-16BE with a byte order mark, UTF-8 with one, or PDFDocEncoding.
+func decodePDFTextString(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		return decodeUTF16BE(b[2:])
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		return string(b[3:])
+	}
+	// PDFDocEncoding matches Latin-1 apart from a few typographic symbols in
+	// 0x80-0x9F, which windows-1252 approximates.
+	text, _ := charmap.Windows1252.NewDecoder().Bytes(b)
+	return string(text)
+}
+
+// pdfLexer reads PDF objects from both file bodies and content streams, where
+// bare keywords are operators.
+type pdfLexer struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+var errPDFEOF = errors.New("pdf: end of data")
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isPDFSpace(c) {
+			l.pos++
+			continue
+		}
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (l *pdfLexer) object() (any, error) {
+	if l.pos < 0 || l.pos > len(l.data) {
+		return nil, errPDFMalformed
+	}
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, errPDFEOF
+	}
+	if l.depth > 64 {
+		return nil, errPDFMalformed
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		return l.name(), nil
+	case c == '(':
+		return l.literalString()
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		return l.dictionary()
+	case c == '<':
+		return l.hexString()
+	case c == '[':
+		return l.array()
+	case c == ']' || c == '>' || c == ')' || c == '{' || c == '}':
+		l.pos++
+		return pdfKeyword(l.data[l.pos-1 : l.pos]), nil
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.numberOrRef(), nil
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	switch word := string(l.data[start:l.pos]); word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	default:
+		return pdfKeyword(word), nil
+	}
+}
+
+func (l *pdfLexer) name() pdfName {
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isPDFSpace(c) || isPDFDelimiter(c) {
+			break
+		}
+		if c == '#' && l.pos+2 < len(l.data) {
+			if v, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				l.pos += 3
+				continue
+			}
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return pdfName(b.String())
+}
+
+func (l *pdfLexer) literalString() (pdfString, error) {
+	l.pos++
+	var b []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		if len(b) >= pdfMaxStringBytes {
+			return nil, errPDFMalformed
+		}
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return b, nil
+			}
+		case '\r':
+			if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+				l.pos++
+			}
+			c = '\n'
+		case '\\':
+			if l.pos >= len(l.data) {
+				return b, nil
+			}
+			esc := l.data[l.pos]
+			l.pos++
+			switch esc {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if esc >= '0' && esc <= '7' {
+					v := int(esc - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				} else {
+					c = esc
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return b, nil
+}
+
+func (l *pdfLexer) hexString() (pdfString, error) {
+	l.pos++
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if len(digits) >= 2*pdfMaxStringBytes {
+			return nil, errPDFMalformed
+		}
+		c := l.data[l.pos]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	if l.pos < len(l.data) {
+		l.pos++
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	decoded := make([]byte, len(digits)/2)
+	_, _ = hex.Decode(decoded, digits)
+	return decoded, nil
+}
+
+func (l *pdfLexer) array() (any, error) {
+	l.pos++
+	l.depth++
+	defer func() { l.depth-- }()
+
+	var items []any
+	for {
+		obj, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		if kw, ok := obj.(pdfKeyword); ok && kw == "]" {
+			return items, nil
+		}
+		if len(items) >= pdfMaxArrayItems {
+			return nil, errPDFMalformed
+		}
+		items = append(items, obj)
+	}
+}
+
+func (l *pdfLexer) dictionary() (any, error) {
+	l.pos += 2
+	l.depth++
+	defer func() { l.depth-- }()
+
+	dict := make(pdfDict)
+	for {
+		l.skipSpace()
+		if l.pos+1 < len(l.data) && l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return dict, nil
+		}
+		key, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			return nil, errPDFMalformed
+		}
+		value, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		dict[string(name)] = value
+	}
+}
+
+// numberOrRef reads a number, or an indirect reference when the number is
+// followed by a generation number and R.
+func (l *pdfLexer) numberOrRef() any {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.data) && (l.data[l.pos] == '.' || (l.data[l.pos] >= '0' && l.data[l.pos] <= '9')) {
+		l.pos++
+	}
+	raw := string(l.data[start:l.pos])
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return float64(0)
+	}
+	if strings.ContainsAny(raw, ".+-") {
+		return value
+	}
+
+	save := l.pos
+	l.skipSpace()
+	genStart := l.pos
+	for l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '9' {
+		l.pos++
+	}
+	if l.pos > genStart {
+		gen, _ := strconv.Atoi(string(l.data[genStart:l.pos]))
+		l.skipSpace()
+		if l.pos < len(l.data) && l.data[l.pos] == 'R' &&
+			(l.pos+1 == len(l.data) || isPDFSpace(l.data[l.pos+1]) || isPDFDelimiter(l.data[l.pos+1])) {
+			l.pos++
+			return pdfRef{num: int(value), gen: gen}
+		}
+	}
+	l.pos = save
+	return value
+}
+
+// streamAfter reads the stream body that may follow dict. It uses /Length
+// when it is direct and consistent, and otherwise searches for endstream.
+func (l *pdfLexer) streamAfter(dict pdfDict) (*pdfStream, int, bool) {
+	l.skipSpace()
+	if !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		return nil, 0, false
+	}
+	start := l.pos + len("stream")
+	if start < len(l.data) && l.data[start] == '\r' {
+		start++
+	}
+	if start < len(l.data) && l.data[start] == '\n' {
+		start++
+	}
+
+	if length, ok := dict["Length"].(float64); ok {
+		end := start + int(length)
+		if end <= len(l.data) && end >= start {
+			rest := bytes.TrimLeft(l.data[end:min(len(l.data), end+32)], "\r\n \t")
+			if bytes.HasPrefix(rest, []byte("endstream")) {
+				return &pdfStream{dict: dict, raw: l.data[start:end]}, end, true
+			}
+		}
+	}
+	idx := bytes.Index(l.data[start:], []byte("endstream"))
+	if idx < 0 {
+		return nil, 0, false
+	}
+	end := start + idx
+	raw := bytes.TrimRight(l.data[start:end], "\r\n")
+	return &pdfStream{dict: dict, raw: raw}, end, true
+}
+
+// skipInlineImage moves past the binary data of an inline image, which runs
+// from the ID operator to an EI surrounded by whitespace.
+func (l *pdfLexer) skipInlineImage() {
+	idx := bytes.Index(l.data[l.pos:], []byte("ID"))
+	if idx < 0 {
+		l.pos = len(l.data)
+		return
+	}
+	l.pos += idx + 2
+	for l.pos < len(l.data) {
+		idx := bytes.Index(l.data[l.pos:], []byte("EI"))
+		if idx < 0 {
+			l.pos = len(l.data)
+			return
+		}
+		at := l.pos + idx
+		before := at == 0 || isPDFSpace(l.data[at-1])
+		after := at+2 >= len(l.data) || isPDFSpace(l.data[at+2])
+		l.pos = at + 2
+		if before && after {
+			return
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+type pdfFixtureObject struct {
+	num  int
+	body string
+}
+
+// buildPDF lays out objects and a classic trailer. The cross-reference table
+// is left empty, as the parser never relies on it.
+func buildPDF(objects []pdfFixtureObject, trailer string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	for _, obj := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", obj.num, obj.body)
+	}
+	fmt.Fprintf(&b, "xref\n0 0\ntrailer\n%s\nstartxref\n0\n%%%%EOF\n", trailer)
+	return b.Bytes()
+}
+
+func pdfStreamObject(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// pdfWithContent is a one-page document whose page uses font F1 and the
+// given Contents value.
+func pdfWithContent(font string, contents string, extra ...pdfFixtureObject) []byte {
+	objects := []pdfFixtureObject{
+		{1, "<< /Type /Catalog /Pages 2 0 R >>"},
+		{2, "<< /Type /Pages /Kids [3 0 R] /Count 1 /Resources << /Font << /F1 4 0 R >> >> >>"},
+		{3, "<< /Type /Page /Parent 2 0 R /Contents " + contents + " >>"},
+		{4, font},
+	}
+	return buildPDF(append(objects, extra...), "<< /Root 1 0 R /Size 10 >>")
+}
+
+const helvetica = "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"
+
+func extractFixture(t *testing.T, data []byte) (*readerResponse, error) {
+	t.Helper()
+	u, _ := url.Parse("https://example.com/paper.pdf")
+	return extractPDFArticle(data, u, u, time.Now().Add(readerTimeout))
+}
+
+func TestExtractPDFArticle(t *testing.T) {
+	toUnicode := []byte(`/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+1 begincodespacerange <0000> <FFFF> endcodespacerange
+2 beginbfchar <0001> <0048> <0002> <0069> endbfchar
+1 beginbfrange <0003> <0004> <00E9> endbfrange
+endcmap
+end end`)
+	plainContent := []byte("BT /F1 12 Tf 72 720 Td (Hello PDF world.) Tj 0 -14 Td (Second \\(line\\) here.) Tj ET")
+
+	objectStreamBody := func() string {
+		page := "<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>"
+		header := fmt.Sprintf("3 0 4 %d ", len(page)+1)
+		data := header + page + " " + helvetica
+		return pdfStreamObject(fmt.Sprintf("/Type /ObjStm /N 2 /First %d /Filter /FlateDecode", len(header)), deflate(t, []byte(data)))
+	}()
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantTitle string
+		wantText  []string
+	}{
+		{
+			name: "plain text with info",
+			data: buildPDF([]pdfFixtureObject{
+				{1, "<< /Type /Catalog /Pages 2 0 R >>"},
+				{2, "<< /Type /Pages /Kids [3 0 R] /Count 1 /Resources << /Font << /F1 4 0 R >> >> >>"},
+				{3, "<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>"},
+				{4, helvetica},
+				{5, pdfStreamObject("", plainContent)},
+				{6, "<< /Title (Fixture Title) /Author <FEFF004100640061> /CreationDate (D:20240102030405Z) >>"},
+			}, "<< /Root 1 0 R /Info 6 0 R /Size 7 >>"),
+			wantTitle: "Fixture Title",
+			wantText:  []string{"Hello PDF world.", "Second (line) here."},
+		},
+		{
+			name:      "flate content and TJ spacing",
+			data:      pdfWithContent(helvetica, "5 0 R", pdfFixtureObject{5, pdfStreamObject("/Filter /FlateDecode", deflate(t, []byte("BT /F1 12 Tf [(Kern)20(ed) -400 (words)] TJ ET")))}),
+			wantTitle: "Kerned words",
+			wantText:  []string{"Kerned words"},
+		},
+		{
+			name: "ToUnicode CMap",
+			data: pdfWithContent("<< /Type /Font /Subtype /Type0 /BaseFont /X /Encoding /Identity-H /ToUnicode 6 0 R >>", "5 0 R",
+				pdfFixtureObject{5, pdfStreamObject("", []byte("BT /F1 12 Tf [<00010002> -250 <00030004>] TJ ET"))},
+				pdfFixtureObject{6, pdfStreamObject("", toUnicode)}),
+			wantText: []string{"Hi éê"},
+		},
+		{
+			name: "object stream",
+			data: buildPDF([]pdfFixtureObject{
+				{1, "<< /Type /Catalog /Pages 2 0 R >>"},
+				{2, "<< /Type /Pages /Kids [3 0 R] /Count 1 /Resources << /Font << /F1 4 0 R >> >> >>"},
+				{5, pdfStreamObject("", plainContent)},
+				{8, objectStreamBody},
+			}, "<< /Root 1 0 R /Size 9 >>"),
+			wantText: []string{"Hello PDF world."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			article, err := extractFixture(t, tt.data)
+			if err != nil {
+				t.Fatalf("extractPDFArticle: %v", err)
+			}
+			if tt.wantTitle != "" && article.Title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", article.Title, tt.wantTitle)
+			}
+			for _, want := range tt.wantText {
+				if !strings.Contains(article.TextContent, want) {
+					t.Errorf("text = %q, want it to contain %q", article.TextContent, want)
+				}
+			}
+			if article.Document == nil || article.Document.Type != "pdf" || article.Document.Pages != 1 {
+				t.Errorf("document = %+v, want one pdf page", article.Document)
+			}
+		})
+	}
+
+	article, err := extractFixture(t, tests[0].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.Byline != "Ada" || article.Document.Created != "2024-01-02T03:04:05Z" {
+		t.Errorf("byline = %q created = %q, want Ada and 2024-01-02T03:04:05Z", article.Byline, article.Document.Created)
+	}
+}
+
+func TestExtractPDFArticleFailures(t *testing.T) {
+	plain := pdfWithContent(helvetica, "5 0 R", pdfFixtureObject{5, pdfStreamObject("", []byte("BT /F1 12 Tf (Text) Tj ET"))})
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{
+			name: "encrypted",
+			data: buildPDF([]pdfFixtureObject{
+				{1, "<< /Type /Catalog /Pages 2 0 R >>"},
+				{9, "<< /Filter /Standard /V 2 /R 3 >>"},
+			}, "<< /Root 1 0 R /Encrypt 9 0 R /Size 10 >>"),
+			want: errPDFEncrypted,
+		},
+		{
+			name: "not a pdf",
+			data: []byte("<html>nope</html>"),
+			want: errPDFMalformed,
+		},
+		{
+			name: "truncated before the trailer",
+			data: plain[:len(plain)/2],
+			want: errPDFMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := extractFixture(t, tt.data); !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("no text", func(t *testing.T) {
+		data := pdfWithContent(helvetica, "5 0 R", pdfFixtureObject{5, pdfStreamObject("", []byte("0 0 m 10 10 l S"))})
+		var readerErr *readerError
+		if _, err := extractFixture(t, data); !errors.As(err, &readerErr) || readerErr.status != 422 {
+			t.Fatalf("error = %v, want a 422 readerError", err)
+		}
+	})
+}
+
+func TestParsePDFMalformedObjectStream(t *testing.T) {
+	for _, header := range []string{"5 -100 ", "5 999999 ", "5 99999999999999999999 ", "-5 0 "} {
+		body := header + "<< /Oops true >>"
+		data := buildPDF([]pdfFixtureObject{
+			{1, "<< /Type /Catalog /Pages 2 0 R >>"},
+			{8, pdfStreamObject(fmt.Sprintf("/Type /ObjStm /N 1 /First %d", len(header)), []byte(body))},
+		}, "<< /Root 1 0 R /Size 9 >>")
+		doc, err := parsePDF(data, time.Time{})
+		if err != nil {
+			t.Fatalf("header %q: parsePDF: %v", header, err)
+		}
+		if _, ok := doc.objects[5]; ok && header != "5 0 " {
+			t.Errorf("header %q: object 5 read from an out-of-range offset", header)
+		}
+	}
+}
+
+// TestParsePDFTruncations runs the parser, without the panic guard in
+// extractPDFArticle, over every prefix of a document.
+func TestParsePDFTruncations(t *testing.T) {
+	data := pdfWithContent("<< /Type /Font /Subtype /Type0 /ToUnicode 6 0 R >>", "[5 0 R 5 0 R]",
+		pdfFixtureObject{5, pdfStreamObject("/Filter /FlateDecode", deflate(t, []byte(`BT /F1 12 Tf [<0001> -300 (x)] TJ (a\) Tj <4 BI /W 1 ID xx EI ET`)))},
+		pdfFixtureObject{6, pdfStreamObject("", []byte("1 beginbfrange <0000> <FFFF> <0041> endbfrange"))})
+	for i := 0; i <= len(data); i++ {
+		doc, err := parsePDF(data[:i], time.Time{})
+		if err != nil {
+			continue
+		}
+		doc.pageTexts()
+		doc.info()
+	}
+}
+
+func TestExtractPDFDecompressionBudget(t *testing.T) {
+	// One stream that inflates to 8 MB, listed enough times to exceed the
+	// document budget many times over.
+	bomb := deflate(t, make([]byte, 8_000_000))
+	refs := strings.Repeat("5 0 R ", 64)
+	data := pdfWithContent(helvetica, "["+refs+"]", pdfFixtureObject{5, pdfStreamObject("/Filter /FlateDecode", bomb)})
+
+	doc, err := parsePDF(data, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.pageTexts()
+	if doc.budget != 0 {
+		t.Fatalf("budget left = %d, want the bomb to exhaust it", doc.budget)
+	}
+	if _, err := extractFixture(t, data); !errors.Is(err, errPDFTooLarge) {
+		t.Fatalf("error = %v, want errPDFTooLarge", err)
+	}
+}
+
+// TestParsePDFUnterminatedObjects checks that objects left open are not
+// lexed again from every header inside them, which made parsing quadratic.
+func TestParsePDFUnterminatedObjects(t *testing.T) {
+	for _, open := range []string{"(", "<", "["} {
+		data := []byte("%PDF-1.7\n" + strings.Repeat("1 0 obj "+open, 80_000))
+		start := time.Now()
+		if _, err := parsePDF(data, time.Now().Add(readerTimeout)); !errors.Is(err, errPDFMalformed) {
+			t.Errorf("%q: error = %v, want errPDFMalformed", open, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%q: parsing %d bytes took %v", open, len(data), elapsed)
+		}
+	}
+
+	data := pdfWithContent(helvetica, "5 0 R", pdfFixtureObject{5, pdfStreamObject("", []byte("BT (x) Tj ET"))})
+	if _, err := parsePDF(data, time.Now().Add(-time.Second)); !errors.Is(err, errPDFDeadline) {
+		t.Fatalf("error = %v, want errPDFDeadline past the deadline", err)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	for n, want := range map[int]string{0: "", 1: "a", 2: "a", 3: "aé", 5: "aé", 6: "aé…", 10: "aé…"} {
+		if got := truncateUTF8("aé…", n); got != want || !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
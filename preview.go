@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/transform"
+)
+
+const (
+	previewMaxHeadBytes = 512_000
+	previewReadChunk    = 32 << 10
+	previewMaxText      = 300
+	previewCacheTTL     = 12 * time.Hour
+	previewFailureTTL   = 10 * time.Minute
+	previewPageParallel = 8
+	previewPageWait     = 3 * time.Second
+)
+
+// previewResponse is the link card for a URL, built from the Open Graph and
+// Twitter tags in its <head>. Image and Favicon point at the image proxy.
+type previewResponse struct {
+	URL         string `json:"url"`
+	FinalURL    string `json:"final_url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Card        string `json:"card,omitempty"`
+	Favicon     string `json:"favicon,omitempty"`
+}
+
+func (s *server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	target, problem := parseExternalURL(r.URL.Query().Get("url"))
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	preview, err := s.fetchPreview(r.Context(), target)
+	if err != nil {
+		var readerErr *readerError
+		if errors.As(err, &readerErr) {
+			writeError(w, readerErr.status, readerErr.message)
+			return
+		}
+		log.Printf("preview fetch failed url=%s: %v", target.String(), err)
+		writeError(w, http.StatusBadGateway, "failed to fetch preview")
+		return
+	}
+
+	writeJSONCached(w, r, http.StatusOK, preview, time.Hour, 10*time.Minute)
+}
+
+// fetchPreview returns the link card for target. Results and failures are
+// cached in s.cache.
+func (s *server) fetchPreview(ctx context.Context, target *url.URL) (*previewResponse, error) {
+	cacheKey := "preview:" + normalizeReaderURL(target)
+	if cached, ok := s.cache.Get(cacheKey); ok {
+		switch v := cached.(type) {
+		case *previewResponse:
+			copied := *v
+			copied.URL = target.String()
+			return &copied, nil
+		case *readerError:
+			return nil, v
+		}
+	}
+
+	result, err := s.flights.Do(ctx, cacheKey, func(ctx context.Context) (any, error) {
+		preview, err := s.loadPreview(ctx, target)
+		if err != nil {
+			var readerErr *readerError
+			if errors.As(err, &readerErr) {
+				s.cache.Set(cacheKey, readerErr, previewFailureTTL)
+			}
+			return nil, err
+		}
+		s.cache.Set(cacheKey, preview, previewCacheTTL)
+		return preview, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	preview, _ := result.(*previewResponse)
+	copied := *preview
+	copied.URL = target.String()
+	return &copied, nil
+}
+
+func (s *server) loadPreview(ctx context.Context, target *url.URL) (*previewResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, readerTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, &readerError{status: http.StatusBadRequest, message: "invalid request URL"}
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.5")
+	req.Header.Set("User-Agent", readerUserAgent)
+
+	resp, err := s.readerClient.Do(req)
+	if err != nil {
+		return nil, guardedFetchError(ctx, target, err, "failed to fetch preview")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > 299 {
+		return nil, &readerError{status: http.StatusBadGateway, message: fmt.Sprintf("upstream request failed (%d)", resp.StatusCode)}
+	}
+
+	finalURL := target
+	if resp.Request != nil && resp.Request.URL != nil {
+		finalURL = resp.Request.URL
+	}
+	preview := &previewResponse{URL: target.String(), FinalURL: finalURL.String()}
+
+	// Links to PDFs, images and the like still get a card, just without any
+	// of the metadata a page would carry.
+	contentType := strings.ToLower(resp.Header.Get(contentTypeHeader))
+	if !strings.Contains(contentType, htmlContentType) && !strings.Contains(contentType, xhtmlContentType) {
+		preview.Favicon = proxiedImageURL(finalURL)("/favicon.ico")
+		return preview, nil
+	}
+
+	head, err := readHTMLHead(resp.Body, previewMaxHeadBytes)
+	if err != nil {
+		log.Printf("preview body read failed url=%s: %v", target.String(), err)
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to fetch preview"}
+	}
+	enc, _ := detectHTMLEncoding(head, resp.Header.Get(contentTypeHeader))
+	parseHTMLHead(transform.NewReader(bytes.NewReader(head), enc.NewDecoder()), finalURL, preview)
+	return preview, nil
+}
+
+// readHTMLHead reads body until the end of its <head> is in view, or limit
+// bytes, so a card does not cost a whole page download.
+func readHTMLHead(body io.Reader, limit int) ([]byte, error) {
+	var head []byte
+	chunk := make([]byte, previewReadChunk)
+	for len(head) < limit {
+		n, err := body.Read(chunk[:min(len(chunk), limit-len(head))])
+		// Only the new bytes, and a tag's length before them, need checking.
+		from := max(0, len(head)-len("</head"))
+		head = append(head, chunk[:n]...)
+		tail := bytes.ToLower(head[from:])
+		if bytes.Contains(tail, []byte("</head")) || bytes.Contains(tail, []byte("<body")) {
+			break
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return head, nil
+}
+
+// parseHTMLHead fills preview from the tags in an HTML head. Open Graph
+// values win over Twitter ones, which win over the plain <title> and meta
+// description. Relative URLs resolve against <base href> when there is one.
+func parseHTMLHead(r io.Reader, pageURL *url.URL, preview *previewResponse) {
+	meta := make(map[string]string)
+	var title, baseHref, icon, touchIcon string
+
+	z := html.NewTokenizer(r)
+	for done := false; !done; {
+		switch z.Next() {
+		case html.ErrorToken:
+			done = true
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				done = true
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			attrs := tagAttrs(z)
+			switch tag {
+			case "body":
+				done = true
+			case "title":
+				if title == "" && z.Next() == html.TextToken {
+					title = string(z.Text())
+				}
+			case "base":
+				if baseHref == "" {
+					baseHref = strings.TrimSpace(attrs["href"])
+				}
+			case "meta":
+				key := strings.ToLower(strings.TrimSpace(attrs["property"]))
+				if key == "" {
+					key = strings.ToLower(strings.TrimSpace(attrs["name"]))
+				}
+				if content := strings.TrimSpace(attrs["content"]); key != "" && content != "" {
+					if _, seen := meta[key]; !seen {
+						meta[key] = content
+					}
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					switch {
+					case rel == "icon" && icon == "":
+						icon = attrs["href"]
+					case rel == "apple-touch-icon" && touchIcon == "":
+						touchIcon = attrs["href"]
+					}
+				}
+			}
+		}
+	}
+
+	first := func(values ...string) string {
+		for _, v := range values {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	preview.Title = clipText(first(meta["og:title"], meta["twitter:title"], title))
+	preview.Description = clipText(first(meta["og:description"], meta["twitter:description"], meta["description"]))
+	preview.SiteName = clipText(meta["og:site_name"])
+	preview.Card = meta["twitter:card"]
+
+	base := pageURL
+	if ref, err := url.Parse(baseHref); err == nil && baseHref != "" {
+		base = pageURL.ResolveReference(ref)
+	}
+	proxied := proxiedImageURL(base)
+	if image := strings.TrimSpace(first(meta["og:image"], meta["og:image:url"], meta["og:image:secure_url"], meta["twitter:image"], meta["twitter:image:src"])); image != "" {
+		preview.Image = proxied(image)
+	}
+	preview.Favicon = proxied(strings.TrimSpace(first(icon, touchIcon, "/favicon.ico")))
+}
+
+// tagAttrs returns the attributes of the current tag, keeping the first of
+// any duplicates.
+func tagAttrs(z *html.Tokenizer) map[string]string {
+	attrs := make(map[string]string)
+	for more := true; more; {
+		var key, val []byte
+		key, val, more = z.TagAttr()
+		if len(key) == 0 {
+			break
+		}
+		if _, seen := attrs[string(key)]; !seen {
+			attrs[string(key)] = string(val)
+		}
+	}
+	return attrs
+}
+
+// clipText collapses whitespace and cuts s to previewMaxText runes.
+func clipText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= previewMaxText {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:previewMaxText-1])) + "…"
+}
+
+// attachPreviews fills in the link cards for stories that can be had within
+// previewPageWait. Slower fetches carry on in the background and are cached
+// for the next request.
+func (s *server) attachPreviews(ctx context.Context, stories []storyResponse) {
+	ctx, cancel := context.WithTimeout(ctx, previewPageWait)
+	defer cancel()
+
+	sem := make(chan struct{}, previewPageParallel)
+	var wg sync.WaitGroup
+	for i := range stories {
+		if stories[i].URL == "" {
+			continue
+		}
+		target, problem := parseExternalURL(stories[i].URL)
+		if problem != "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			if preview, err := s.fetchPreview(ctx, target); err == nil {
+				stories[i].Preview = preview
+			}
+		}()
+	}
+	wg.Wait()
+}
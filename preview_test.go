@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseHTMLHead(t *testing.T) {
+	page, _ := url.Parse("https://example.com/posts/a.html")
+	head := `<!doctype html><html><head>
+<title>Plain &amp; simple</title>
+<base href="https://cdn.example.com/assets/">
+<meta name="description" content="meta description">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:title" content="Twitter title">
+<meta property="og:title" content="  Open   Graph title ">
+<meta property="og:title" content="second og:title">
+<meta property="og:image" content="img/card.png">
+<meta property="og:site_name" content="Example">
+<link rel="apple-touch-icon" href="/touch.png">
+<link rel="shortcut icon" href="favicon.ico">
+</head><body><meta property="og:description" content="from the body"></body></html>`
+
+	var preview previewResponse
+	parseHTMLHead(strings.NewReader(head), page, &preview)
+
+	want := previewResponse{
+		Title:       "Open Graph title",
+		Description: "meta description",
+		SiteName:    "Example",
+		Card:        "summary_large_image",
+		Image:       "/api/image?url=" + url.QueryEscape("https://cdn.example.com/assets/img/card.png"),
+		Favicon:     "/api/image?url=" + url.QueryEscape("https://cdn.example.com/assets/favicon.ico"),
+	}
+	if preview != want {
+		t.Fatalf("preview =\n%+v\nwant\n%+v", preview, want)
+	}
+}
+
+func TestParseHTMLHeadFallbacks(t *testing.T) {
+	page, _ := url.Parse("https://example.com/a")
+	var preview previewResponse
+	parseHTMLHead(strings.NewReader(`<title>`+strings.Repeat("word ", 100)+`</title>`), page, &preview)
+
+	if got := []rune(preview.Title); len(got) != previewMaxText || got[len(got)-1] != '…' {
+		t.Errorf("title has %d runes ending %q, want %d ending in an ellipsis", len(got), got[len(got)-1], previewMaxText)
+	}
+	if preview.Image != "" {
+		t.Errorf("image = %q, want none", preview.Image)
+	}
+	if want := "/api/image?url=" + url.QueryEscape("https://example.com/favicon.ico"); preview.Favicon != want {
+		t.Errorf("favicon = %q, want %q", preview.Favicon, want)
+	}
+}
+
+func TestReadHTMLHeadStopsAtBody(t *testing.T) {
+	page := "<html><head><title>t</title></head><body>" + strings.Repeat("x", 4*previewReadChunk)
+	head, err := readHTMLHead(strings.NewReader(page), previewMaxHeadBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(head) > previewReadChunk {
+		t.Fatalf("read %d bytes, want at most one chunk", len(head))
+	}
+
+	head, err = readHTMLHead(strings.NewReader(strings.Repeat("y", 3*previewReadChunk)), previewReadChunk+10)
+	if err != nil || len(head) != previewReadChunk+10 {
+		t.Fatalf("read %d bytes (err %v), want the limit", len(head), err)
+	}
+}
+
+func TestFetchPreviewCachesResult(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set(contentTypeHeader, "text/html; charset=windows-1252")
+		w.Write([]byte("<head><meta property=\"og:title\" content=\"Caf\xe9\"></head>"))
+	}))
+	defer upstream.Close()
+
+	s := &server{
+		readerClient: newGuardedClient(func(netip.Addr) bool { return true }),
+		cache:        newTTLRUCache(16),
+		flights:      newFlightGroup(),
+	}
+	target, _ := url.Parse(upstream.URL + "/story?utm_source=hn")
+	for i := 0; i < 2; i++ {
+		preview, err := s.fetchPreview(context.Background(), target)
+		if err != nil {
+			t.Fatalf("fetchPreview: %v", err)
+		}
+		if preview.Title != "Café" || preview.URL != target.String() {
+			t.Fatalf("preview = %+v", preview)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("upstream hit %d times, want 1", hits.Load())
+	}
+
+	s.readerClient = newGuardedClient(isPublicAddr)
+	rec := httptest.NewRecorder()
+	s.handlePreview(rec, httptest.NewRequest(http.MethodGet, "/api/preview?url="+url.QueryEscape(upstream.URL+"/other"), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("loopback preview status = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	readability "github.com/go-shiori/go-readability"
+)
+
+const (
+	readerCacheTTL        = 6 * time.Hour
+	readerStaleGrace      = 18 * time.Hour
+	readerFailureTTL      = 2 * time.Minute
+	readerPrewarmParallel = 4
+	readerPrewarmTimeout  = 2 * time.Minute
+	readerCacheEntries    = 256
+	readerCacheMaxBytes   = 64 << 20
+)
+
+// readerError is an extraction failure with the status and message handed
+// to the client. Failures are cached briefly so a broken link on the front
+// page is not refetched by every reader.
+type readerError struct {
+	status  int
+	message string
+	// upstream is the status the article's server answered with, when the
+	// failure was its response rather than ours.
+	upstream int
+}
+
+func (e *readerError) Error() string {
+	return e.message
+}
+
+// readerTrackingParams are query parameters that never change the article a
+// URL points at.
+var readerTrackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"ref_src": true,
+}
+
+// normalizeReaderURL maps equivalent article URLs onto one cache key: the
+// scheme and host are lowercased, default ports, fragments and tracking
+// parameters dropped, and the remaining query sorted.
+func normalizeReaderURL(u *url.URL) string {
+	normalized := *u
+	normalized.Scheme = strings.ToLower(normalized.Scheme)
+	host := strings.ToLower(normalized.Hostname())
+	port := normalized.Port()
+	if (normalized.Scheme == "http" && port == "80") || (normalized.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	normalized.Host = host
+	normalized.User = nil
+	normalized.Fragment = ""
+	normalized.RawFragment = ""
+	if normalized.Path == "" {
+		normalized.Path = "/"
+		normalized.RawPath = ""
+	}
+
+	query := normalized.Query()
+	for key := range query {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") || readerTrackingParams[strings.ToLower(key)] {
+			query.Del(key)
+		}
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var encoded strings.Builder
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			if encoded.Len() > 0 {
+				encoded.WriteByte('&')
+			}
+			encoded.WriteString(url.QueryEscape(key))
+			encoded.WriteByte('=')
+			encoded.WriteString(url.QueryEscape(value))
+		}
+	}
+	normalized.RawQuery = encoded.String()
+	normalized.ForceQuery = false
+	return normalized.String()
+}
+
+// parseExternalURL validates a client-supplied absolute http(s) URL. The
+// returned message is suitable for a 400 response.
+func parseExternalURL(raw string) (*url.URL, string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, "missing url parameter"
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return nil, "invalid url parameter"
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, "url must use http or https"
+	}
+	return parsed, ""
+}
+
+// guardedFetchError maps a failed readerClient request to the error the
+// client sees; fallback is the message for failures with no better one.
+func guardedFetchError(ctx context.Context, target *url.URL, err error, fallback string) *readerError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &readerError{status: http.StatusGatewayTimeout, message: "upstream request timed out"}
+	}
+	var blocked *blockedAddressError
+	if errors.As(err, &blocked) {
+		log.Printf("guarded request blocked url=%s: %v", target.String(), err)
+		return &readerError{status: http.StatusForbidden, message: "url resolves to a non-public address"}
+	}
+	if errors.Is(err, errTooManyRedirects) {
+		return &readerError{status: http.StatusBadGateway, message: fmt.Sprintf("upstream redirected more than %d times", readerMaxRedirects)}
+	}
+	log.Printf("guarded request failed url=%s: %v", target.String(), err)
+	return &readerError{status: http.StatusBadGateway, message: fallback}
+}
+
+// fetchReader returns the extracted article for target, from the cache when
+// this URL, or another URL that redirected to the same page, was read
+// recently.
+func (s *server) fetchReader(ctx context.Context, target *url.URL) (*readerResponse, error) {
+	cacheKey := "reader:" + normalizeReaderURL(target)
+	if cached, ok, refresh := s.readers.Lookup(cacheKey); ok {
+		if refresh {
+			s.refreshInBackground(s.readers, cacheKey, func(ctx context.Context) error {
+				_, err := s.loadReader(ctx, target)
+				return err
+			})
+		}
+		switch v := cached.(type) {
+		case *readerResponse:
+			return cloneReader(v, target), nil
+		case *readerError:
+			return nil, v
+		}
+	}
+
+	article, err := s.loadReader(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return cloneReader(article, target), nil
+}
+
+func (s *server) loadReader(ctx context.Context, target *url.URL) (*readerResponse, error) {
+	cacheKey := "reader:" + normalizeReaderURL(target)
+	result, err := s.flights.Do(ctx, cacheKey, func(ctx context.Context) (any, error) {
+		article, err := s.extractArticle(ctx, target)
+		if err != nil {
+			// A failed refresh keeps serving the stale article rather than
+			// replacing it with the error.
+			var readerErr *readerError
+			if errors.As(err, &readerErr) {
+				if _, cached := s.readers.Peek(cacheKey).(*readerResponse); !cached {
+					s.readers.Set(cacheKey, readerErr, readerFailureTTL)
+				}
+			}
+			return nil, err
+		}
+
+		s.readers.SetWithGrace(cacheKey, article, readerCacheTTL, readerStaleGrace)
+		if finalURL, err := url.Parse(article.FinalURL); err == nil {
+			if finalKey := "reader:" + normalizeReaderURL(finalURL); finalKey != cacheKey {
+				s.readers.SetWithGrace(finalKey, article, readerCacheTTL, readerStaleGrace)
+			}
+		}
+		return article, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	article, _ := result.(*readerResponse)
+	return article, nil
+}
+
+// extractArticle downloads target and runs readability over it, falling
+// back to s.archives when the site refuses, times out or paywalls the
+// article. Content is sanitized and annotated here, once, so cached articles
+// are safe to serve as is, and its images are pointed at the image proxy.
+// Failures the client should see are returned as *readerError.
+func (s *server) extractArticle(ctx context.Context, target *url.URL) (*readerResponse, error) {
+	article, err := s.extractArticleFrom(ctx, target, target)
+	if err == nil {
+		article.Source = readerSourceOrigin
+	}
+	if !needsArchive(article, err) || len(s.archives) == 0 {
+		return article, err
+	}
+	return s.extractFromArchives(ctx, target, article, err)
+}
+
+// extractArticleFrom extracts the article at target by downloading source,
+// which is target itself or an archived copy of it.
+func (s *server) extractArticleFrom(ctx context.Context, target *url.URL, source *url.URL) (*readerResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, readerTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return nil, &readerError{status: http.StatusBadRequest, message: "invalid request URL"}
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/pdf;q=0.9")
+	req.Header.Set("User-Agent", readerUserAgent)
+
+	resp, err := s.readerClient.Do(req)
+	if err != nil {
+		return nil, guardedFetchError(ctx, source, err, "failed to fetch article")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > 299 {
+		return nil, &readerError{status: http.StatusBadGateway, message: fmt.Sprintf("upstream request failed (%d)", resp.StatusCode), upstream: resp.StatusCode}
+	}
+
+	finalURL := source
+	if resp.Request != nil && resp.Request.URL != nil {
+		finalURL = resp.Request.URL
+	}
+
+	contentType := strings.ToLower(resp.Header.Get(contentTypeHeader))
+	if isPDFResponse(contentType, finalURL) {
+		return extractPDF(ctx, resp.Body, target, finalURL)
+	}
+	if !strings.Contains(contentType, htmlContentType) && !strings.Contains(contentType, xhtmlContentType) {
+		return nil, &readerError{status: http.StatusUnsupportedMediaType, message: "URL did not return HTML or PDF"}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, readerMaxHTMLBytes))
+	if err != nil {
+		log.Printf("reader body read failed url=%s: %v", source.String(), err)
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to fetch article"}
+	}
+	doc, charsetName, err := parseHTMLDocument(body, resp.Header.Get(contentTypeHeader))
+	if err != nil {
+		log.Printf("html parse failed url=%s: %v", source.String(), err)
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to extract article"}
+	}
+	article, err := readability.FromDocument(doc, finalURL)
+	if err != nil {
+		log.Printf("readability parse failed url=%s: %v", source.String(), err)
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to extract article"}
+	}
+
+	if strings.TrimSpace(article.Content) == "" && strings.TrimSpace(article.TextContent) == "" {
+		return nil, &readerError{status: http.StatusBadGateway, message: "article content was empty"}
+	}
+
+	response := &readerResponse{
+		URL:         target.String(),
+		FinalURL:    finalURL.String(),
+		Title:       article.Title,
+		Byline:      article.Byline,
+		SiteName:    article.SiteName,
+		Excerpt:     article.Excerpt,
+		Content:     sanitizeHTMLWith(article.Content, proxiedImageURL(finalURL)),
+		TextContent: article.TextContent,
+		Length:      article.Length,
+		Charset:     charsetName,
+		Paywalled:   declaresPaywall(body),
+	}
+	annotateArticle(response, article.Language)
+	return response, nil
+}
+
+// extractPDF reads a PDF body of at most readerMaxPDFBytes and extracts its
+// text, giving up at ctx's deadline. Unlike HTML, a truncated PDF is
+// unreadable, so oversized files fail.
+func extractPDF(ctx context.Context, body io.Reader, target *url.URL, finalURL *url.URL) (*readerResponse, error) {
+	data, err := io.ReadAll(io.LimitReader(body, readerMaxPDFBytes+1))
+	if err != nil {
+		log.Printf("reader pdf read failed url=%s: %v", target.String(), err)
+		return nil, &readerError{status: http.StatusBadGateway, message: "failed to fetch article"}
+	}
+	if len(data) > readerMaxPDFBytes {
+		return nil, &readerError{status: http.StatusBadGateway, message: fmt.Sprintf("PDF is larger than %d MB", readerMaxPDFBytes/1_000_000)}
+	}
+
+	deadline, _ := ctx.Deadline()
+	article, err := extractPDFArticle(data, target, finalURL, deadline)
+	if err != nil {
+		var readerErr *readerError
+		switch {
+		case errors.As(err, &readerErr):
+			return nil, err
+		case errors.Is(err, errPDFEncrypted):
+			return nil, &readerError{status: http.StatusUnprocessableEntity, message: "PDF is encrypted"}
+		case errors.Is(err, errPDFDeadline):
+			return nil, &readerError{status: http.StatusGatewayTimeout, message: "PDF took too long to parse"}
+		case errors.Is(err, errPDFTooLarge):
+			return nil, &readerError{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("PDF decompresses to more than %d MB", readerMaxPDFDecodedBytes/1_000_000)}
+		default:
+			log.Printf("pdf extraction failed url=%s: %v", target.String(), err)
+			return nil, &readerError{status: http.StatusBadGateway, message: "failed to extract PDF"}
+		}
+	}
+	article.Content = sanitizeHTML(article.Content)
+	annotateArticle(article, "")
+	return article, nil
+}
+
+// readerCacheSize approximates the memory held by a reader cache value. It
+// bounds the reader cache, which holds documents of up to a few megabytes
+// apiece.
+func readerCacheSize(value any) int64 {
+	switch v := value.(type) {
+	case *readerResponse:
+		size := len(v.URL) + len(v.FinalURL) + len(v.Title) + len(v.Byline) + len(v.SiteName) +
+			len(v.Excerpt) + len(v.Content) + len(v.TextContent) + len(v.Language) + len(v.Charset) + len(v.Source)
+		for _, entry := range v.Outline {
+			size += len(entry.ID) + len(entry.Text) + 16
+		}
+		if v.Document != nil {
+			size += len(v.Document.Subject) + len(v.Document.Keywords) + len(v.Document.Creator) +
+				len(v.Document.Producer) + len(v.Document.Created) + len(v.Document.Modified)
+		}
+		return int64(size) + 256
+	case *readerError:
+		return int64(len(v.message)) + 64
+	default:
+		return 256
+	}
+}
+
+// cloneReader copies a cached extraction and reports the URL this caller
+// asked for, which may differ from the one that populated the cache.
+func cloneReader(article *readerResponse, requested *url.URL) *readerResponse {
+	if article == nil {
+		return nil
+	}
+	copied := *article
+	copied.URL = requested.String()
+	return &copied
+}
+
+// prewarmReader extracts the linked articles of stories ahead of time so the
+// reader opens instantly from the front page.
+func (s *server) prewarmReader(ctx context.Context, feedName string, stories []storyResponse) {
+	ctx, cancel := context.WithTimeout(ctx, readerPrewarmTimeout)
+	defer cancel()
+
+	sem := make(chan struct{}, readerPrewarmParallel)
+	var wg sync.WaitGroup
+	warmed := 0
+	var mu sync.Mutex
+	for _, story := range stories {
+		target, err := url.ParseRequestURI(story.URL)
+		if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			if _, err := s.fetchReader(ctx, target); err == nil {
+				mu.Lock()
+				warmed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	log.Printf("reader prewarm complete for feed=%s count=%d", feedName, warmed)
+}
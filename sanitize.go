@@ -0,0 +1,256 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// linkRel is set on every sanitized link so user-supplied URLs gain no
+// ranking from us and cannot script the opener.
+const linkRel = "nofollow noopener"
+
+// sanitizeGlobalAttrs are attributes kept on any allowed element.
+var sanitizeGlobalAttrs = map[string]bool{
+	"title": true,
+	"lang":  true,
+	"dir":   true,
+}
+
+// sanitizeAllowed lists the elements that survive sanitizing and any
+// attributes they keep beyond sanitizeGlobalAttrs. Elements outside this list
+// are unwrapped, keeping their text, unless sanitizeDropped removes them
+// outright.
+var sanitizeAllowed = map[atom.Atom]map[string]bool{
+	atom.A:          {"href": true, "target": true},
+	atom.Abbr:       nil,
+	atom.Article:    nil,
+	atom.B:          nil,
+	atom.Blockquote: {"cite": true},
+	atom.Br:         nil,
+	atom.Caption:    nil,
+	atom.Cite:       nil,
+	atom.Code:       nil,
+	atom.Col:        {"span": true},
+	atom.Colgroup:   {"span": true},
+	atom.Dd:         nil,
+	atom.Del:        {"cite": true, "datetime": true},
+	atom.Details:    nil,
+	atom.Dfn:        nil,
+	atom.Div:        nil,
+	atom.Dl:         nil,
+	atom.Dt:         nil,
+	atom.Em:         nil,
+	atom.Figcaption: nil,
+	atom.Figure:     nil,
+	atom.H1:         {"id": true},
+	atom.H2:         {"id": true},
+	atom.H3:         {"id": true},
+	atom.H4:         {"id": true},
+	atom.H5:         {"id": true},
+	atom.H6:         {"id": true},
+	atom.Hr:         nil,
+	atom.I:          nil,
+	atom.Img:        {"src": true, "alt": true, "width": true, "height": true},
+	atom.Ins:        {"cite": true, "datetime": true},
+	atom.Kbd:        nil,
+	atom.Li:         {"value": true},
+	atom.Mark:       nil,
+	atom.Ol:         {"start": true, "reversed": true, "type": true},
+	atom.P:          nil,
+	atom.Pre:        nil,
+	atom.Q:          {"cite": true},
+	atom.S:          nil,
+	atom.Samp:       nil,
+	atom.Section:    nil,
+	atom.Small:      nil,
+	atom.Span:       nil,
+	atom.Strong:     nil,
+	atom.Sub:        nil,
+	atom.Summary:    nil,
+	atom.Sup:        nil,
+	atom.Table:      nil,
+	atom.Tbody:      nil,
+	atom.Td:         {"colspan": true, "rowspan": true},
+	atom.Tfoot:      nil,
+	atom.Th:         {"colspan": true, "rowspan": true, "scope": true},
+	atom.Thead:      nil,
+	atom.Time:       {"datetime": true},
+	atom.Tr:         nil,
+	atom.U:          nil,
+	atom.Ul:         nil,
+	atom.Var:        nil,
+}
+
+// sanitizeDropped are elements removed together with their content, because
+// that content is code, styling or form state rather than readable text.
+var sanitizeDropped = map[atom.Atom]bool{
+	atom.Applet:   true,
+	atom.Audio:    true,
+	atom.Base:     true,
+	atom.Button:   true,
+	atom.Canvas:   true,
+	atom.Embed:    true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Head:     true,
+	atom.Iframe:   true,
+	atom.Input:    true,
+	atom.Link:     true,
+	atom.Math:     true,
+	atom.Meta:     true,
+	atom.Noembed:  true,
+	atom.Noframes: true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Style:    true,
+	atom.Svg:      true,
+	atom.Template: true,
+	atom.Textarea: true,
+	atom.Title:    true,
+	atom.Video:    true,
+}
+
+// sanitizeURLAttrs are the attributes whose values are URLs and must pass
+// safeURL.
+var sanitizeURLAttrs = map[string]bool{
+	"href": true,
+	"src":  true,
+	"cite": true,
+}
+
+// sanitizeHTML reduces an HTML fragment to the elements and attributes in
+// sanitizeAllowed. Comments, event handlers, inline styles and non-http(s)
+// URLs are removed, and links are rewritten with rel="nofollow noopener".
+// Text that fails to parse is returned escaped.
+func sanitizeHTML(fragment string) string {
+	return sanitizeHTMLWith(fragment, nil)
+}
+
+// sanitizeHTMLWith is sanitizeHTML with every surviving image src passed
+// through imageSrc, which may return "" to drop the image.
+func sanitizeHTMLWith(fragment string, imageSrc func(string) string) string {
+	if strings.TrimSpace(fragment) == "" {
+		return fragment
+	}
+	root, err := parseArticleHTML(fragment)
+	if err != nil {
+		return html.EscapeString(fragment)
+	}
+	sanitizeChildren(root, imageSrc)
+
+	var b strings.Builder
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&b, c); err != nil {
+			return html.EscapeString(fragment)
+		}
+	}
+	return b.String()
+}
+
+func sanitizeChildren(parent *html.Node, imageSrc func(string) string) {
+	for c := parent.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.TextNode:
+		case html.ElementNode:
+			allowed, ok := sanitizeAllowed[c.DataAtom]
+			switch {
+			case c.Namespace != "" || sanitizeDropped[c.DataAtom]:
+				parent.RemoveChild(c)
+			case !ok:
+				// Unknown or disallowed markup is unwrapped so its text
+				// survives; the hoisted children are already sanitized.
+				sanitizeChildren(c, imageSrc)
+				for c.FirstChild != nil {
+					child := c.FirstChild
+					c.RemoveChild(child)
+					parent.InsertBefore(child, c)
+				}
+				parent.RemoveChild(c)
+			default:
+				c.Attr = sanitizeAttrs(c, allowed)
+				if c.DataAtom == atom.Img && !sanitizeImage(c, imageSrc) {
+					parent.RemoveChild(c)
+					break
+				}
+				sanitizeChildren(c, imageSrc)
+			}
+		default:
+			parent.RemoveChild(c)
+		}
+		c = next
+	}
+}
+
+func sanitizeAttrs(n *html.Node, allowed map[string]bool) []html.Attribute {
+	var kept []html.Attribute
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		if a.Namespace != "" || (!allowed[key] && !sanitizeGlobalAttrs[key]) {
+			continue
+		}
+		switch {
+		case sanitizeURLAttrs[key]:
+			cleaned, ok := safeURL(a.Val, key == "href")
+			if !ok {
+				continue
+			}
+			a.Val = cleaned
+		case key == "target" && a.Val != "_blank":
+			continue
+		}
+		kept = append(kept, html.Attribute{Key: key, Val: a.Val})
+	}
+	if n.DataAtom == atom.A {
+		kept = append(kept, html.Attribute{Key: "rel", Val: linkRel})
+	}
+	return kept
+}
+
+// sanitizeImage rewrites the src of img through imageSrc and reports whether
+// the image still has one.
+func sanitizeImage(img *html.Node, imageSrc func(string) string) bool {
+	for i, a := range img.Attr {
+		if a.Key != "src" {
+			continue
+		}
+		if imageSrc != nil {
+			img.Attr[i].Val = imageSrc(a.Val)
+		}
+		return img.Attr[i].Val != ""
+	}
+	return false
+}
+
+// safeURL reports whether raw is a relative URL or uses http or https, or
+// mailto for links. Tabs and newlines are stripped first, as browsers do,
+// so "java\nscript:" cannot slip through.
+func safeURL(raw string, link bool) (string, bool) {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, raw)
+	cleaned = strings.TrimFunc(cleaned, func(r rune) bool { return r <= ' ' })
+	if cleaned == "" {
+		return "", false
+	}
+	parsed, err := url.Parse(cleaned)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "", "http", "https":
+		return cleaned, true
+	case "mailto":
+		return cleaned, link
+	default:
+		return "", false
+	}
+}
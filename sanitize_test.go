@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"plain text", "just text", "just text"},
+		{"hn comment markup", `<p>See <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow">this</a></p><pre><code>x &lt; y</code></pre>`,
+			`<p>See <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener">this</a></p><pre><code>x &lt; y</code></pre>`},
+		{"script dropped with content", `a<script>alert(1)</script>b`, "ab"},
+		{"style dropped with content", `<style>body{display:none}</style>x`, "x"},
+		{"event handlers", `<p onclick="alert(1)" onmouseover="x()">hi</p>`, "<p>hi</p>"},
+		{"img onerror", `<img src="https://example.com/a.png" onerror="alert(1)">`, `<img src="https://example.com/a.png"/>`},
+		{"style attribute", `<b style="position:fixed">bold</b>`, "<b>bold</b>"},
+		{"javascript href", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"uppercase scheme", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"tab in scheme", "<a href=\"java\tscript:alert(1)\">x</a>", `<a rel="nofollow noopener">x</a>`},
+		{"newline in scheme", "<a href=\"java\nscript:alert(1)\">x</a>", `<a rel="nofollow noopener">x</a>`},
+		{"entity encoded scheme", `<a href="&#106;avascript:alert(1)">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"entity encoded tab", `<a href="java&#x09;script:alert(1)">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"leading control characters", "<a href=\" \x01javascript:alert(1)\">x</a>", `<a rel="nofollow noopener">x</a>`},
+		{"data url", `<a href="data:text/html,<script>alert(1)</script>">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"vbscript", `<a href="vbscript:msgbox(1)">x</a>`, `<a rel="nofollow noopener">x</a>`},
+		{"mailto link", `<a href="mailto:pg@example.com">mail</a>`, `<a href="mailto:pg@example.com" rel="nofollow noopener">mail</a>`},
+		{"mailto image", `<img src="mailto:pg@example.com">`, ""},
+		{"javascript image", `<img src="javascript:alert(1)">x`, "x"},
+		{"relative link", `<a href="/item?id=1">x</a>`, `<a href="/item?id=1" rel="nofollow noopener">x</a>`},
+		{"existing rel replaced", `<a href="https://e.com" rel="opener">x</a>`, `<a href="https://e.com" rel="nofollow noopener">x</a>`},
+		{"target blank kept", `<a href="https://e.com" target="_blank">x</a>`, `<a href="https://e.com" target="_blank" rel="nofollow noopener">x</a>`},
+		{"other target dropped", `<a href="https://e.com" target="_parent">x</a>`, `<a href="https://e.com" rel="nofollow noopener">x</a>`},
+		{"svg payload", `<svg><script>alert(1)</script><a xlink:href="javascript:alert(1)">x</a></svg>ok`, "ok"},
+		{"svg onload", `<svg onload="alert(1)"/>ok`, "ok"},
+		{"math payload", `<math><mtext><img src=x onerror=alert(1)></mtext></math>ok`, "ok"},
+		{"iframe", `<iframe src="https://evil.example"></iframe>ok`, "ok"},
+		{"form controls", `<form action="/x"><input value="secret"><button>go</button>text</form>`, "text"},
+		{"unknown tag unwrapped", `<font color="red">kept <b>bold</b></font>`, "kept <b>bold</b>"},
+		{"custom element unwrapped", `<x-widget data-a="1">inner</x-widget>`, "inner"},
+		{"comment removed", `a<!-- <script>alert(1)</script> -->b`, "ab"},
+		{"heading ids kept", `<h2 id="intro" class="title">Intro</h2>`, `<h2 id="intro">Intro</h2>`},
+		{"ids dropped elsewhere", `<p id="cookie">x</p>`, "<p>x</p>"},
+		{"table attributes", `<table><tr><td colspan="2" bgcolor="red">x</td></tr></table>`, `<table><tbody><tr><td colspan="2">x</td></tr></tbody></table>`},
+		{"unclosed markup", `<p><b>open`, "<p><b>open</b></p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeHTML(tt.in); got != tt.want {
+				t.Errorf("sanitizeHTML(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadItemSanitizesText(t *testing.T) {
+	raw := `Hi<script>alert(1)</script><p><a href="javascript:x()" onclick="y()">there</a>`
+	s, _ := newFakeFirebaseServer(t, &hnItem{ID: 5, Type: "comment", Parent: 1, Text: raw})
+	item, err := s.loadItem(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sanitizeHTML(raw); item.Text != want || strings.Contains(item.Text, "script") {
+		t.Fatalf("loaded text = %q, want %q", item.Text, want)
+	}
+	if cached, _ := s.cache.Peek("item:5").(*hnItem); cached == nil || cached.Text != item.Text {
+		t.Fatalf("cached item = %+v, want the sanitized text", cached)
+	}
+	if got := toCommentResponse(item).Text; got != item.Text {
+		t.Errorf("comment text = %q, want the cached text unchanged", got)
+	}
+}
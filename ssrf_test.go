@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"::ffff:8.8.8.8", true},
+		{"100.128.0.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.1.2.3", false},
+		{"::ffff:169.254.169.254", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"0.0.0.0", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b:1::a00:1", false},
+		{"2002:7f00:1::1", false},
+		{"2002:a9fe:a9fe::1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"2001:db8::1", false},
+		{"2001:4860:4860::8888", true},
+		{"2003::1", true},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestGuardedClientRefusesLoopback(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	_, err := newGuardedClient(isPublicAddr).Get(upstream.URL)
+	var blocked *blockedAddressError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("Get(%s) error = %v, want *blockedAddressError", upstream.URL, err)
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("loopback server received %d requests", hits.Load())
+	}
+
+	s := &server{readerClient: newGuardedClient(isPublicAddr)}
+	target, _ := url.Parse(upstream.URL)
+	_, err = s.extractArticle(context.Background(), target)
+	var readerErr *readerError
+	if !errors.As(err, &readerErr) || readerErr.status != http.StatusForbidden {
+		t.Fatalf("extractArticle error = %v, want 403 readerError", err)
+	}
+}
+
+func TestGuardedClientRefusesRedirectToLoopback(t *testing.T) {
+	// 127.0.0.1 stands in for a public host; the redirect target listens on
+	// another loopback address, which the policy still refuses.
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	var internalHits atomic.Int32
+	internal := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalHits.Add(1)
+	}))
+	internal.Listener.Close()
+	internal.Listener = listener
+	internal.Start()
+	defer internal.Close()
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/latest/meta-data", http.StatusFound)
+	}))
+	defer public.Close()
+
+	allow := func(addr netip.Addr) bool {
+		return addr == netip.MustParseAddr("127.0.0.1") || isPublicAddr(addr)
+	}
+	_, err = newGuardedClient(allow).Get(public.URL)
+	var blocked *blockedAddressError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("Get error = %v, want *blockedAddressError", err)
+	}
+	if blocked.addr != netip.MustParseAddr("127.0.0.2") {
+		t.Fatalf("blocked address = %s, want 127.0.0.2", blocked.addr)
+	}
+	if internalHits.Load() != 0 {
+		t.Fatalf("internal server received %d requests", internalHits.Load())
+	}
+}
+
+func TestGuardedClientCapsRedirects(t *testing.T) {
+	var hits atomic.Int32
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	defer loop.Close()
+
+	allowAll := func(netip.Addr) bool { return true }
+	_, err := newGuardedClient(allowAll).Get(loop.URL)
+	if !errors.Is(err, errTooManyRedirects) {
+		t.Fatalf("Get error = %v, want errTooManyRedirects", err)
+	}
+	if got, want := int(hits.Load()), readerMaxRedirects+1; got != want {
+		t.Fatalf("server saw %d requests, want %d", got, want)
+	}
+}
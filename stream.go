@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventStreamContentType = "text/event-stream; charset=utf-8"
+	streamPollInterval     = 10 * time.Second
+	streamHeartbeatEvery   = 20 * time.Second
+	streamRetryMillis      = 5000
+	streamMaxNewItems      = 250
+	streamMaxParentHops    = 64
+	streamSubscriberBuffer = 64
+	streamRootCacheMax     = 20_000
+)
+
+// firebaseUpdates is the shape of Firebase's updates.json: the IDs of items
+// and profiles that changed recently.
+type firebaseUpdates struct {
+	Items    []int    `json:"items"`
+	Profiles []string `json:"profiles"`
+}
+
+type streamEvent struct {
+	id   int64
+	name string
+	data []byte
+	// Routing: story events go to everyone, updates to subscribers watching
+	// one of the story's feeds or its thread, comments only to the thread.
+	storyID    int
+	feeds      map[string]bool
+	threadOnly bool
+}
+
+type streamSubscriber struct {
+	feed   string
+	thread int
+	events chan streamEvent
+}
+
+func (sub *streamSubscriber) wants(event streamEvent) bool {
+	if event.threadOnly {
+		return sub.thread != 0 && sub.thread == event.storyID
+	}
+	if event.feeds == nil {
+		return true
+	}
+	return (sub.thread != 0 && sub.thread == event.storyID) || (sub.feed != "" && event.feeds[sub.feed])
+}
+
+type storySnapshot struct {
+	score       int
+	descendants int
+}
+
+type streamStoryUpdate struct {
+	ID          int      `json:"id"`
+	Score       int      `json:"score"`
+	Descendants int      `json:"descendants"`
+	Feeds       []string `json:"feeds,omitempty"`
+}
+
+type streamComment struct {
+	StoryID int              `json:"story_id"`
+	Parent  int              `json:"parent"`
+	Comment *commentResponse `json:"comment"`
+}
+
+// storyStream follows Firebase's maxitem.json and updates.json on a single
+// poller shared by every connected /api/stream client. The poller runs only
+// while at least one client is subscribed.
+type storyStream struct {
+	s *server
+
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	cancel      context.CancelFunc
+	nextID      int64
+}
+
+// streamPoller is the state of one poller run. A fresh one is created each
+// time the first client subscribes, so a run winding down after the last
+// client left never shares state with its successor.
+type streamPoller struct {
+	st          *storyStream
+	lastMaxItem int
+	snapshots   map[int]storySnapshot
+	rootOf      map[int]int
+}
+
+func newStoryStream(s *server) *storyStream {
+	return &storyStream{
+		s:           s,
+		subscribers: make(map[*streamSubscriber]struct{}),
+	}
+}
+
+func (st *storyStream) subscribe(feed string, thread int) *streamSubscriber {
+	sub := &streamSubscriber{
+		feed:   feed,
+		thread: thread,
+		events: make(chan streamEvent, streamSubscriberBuffer),
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.subscribers[sub] = struct{}{}
+	if st.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		st.cancel = cancel
+		go st.run(ctx)
+	}
+	return sub
+}
+
+func (st *storyStream) unsubscribe(sub *streamSubscriber) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.subscribers, sub)
+	if len(st.subscribers) == 0 && st.cancel != nil {
+		st.cancel()
+		st.cancel = nil
+	}
+}
+
+// watched returns the feeds and threads current subscribers care about.
+func (st *storyStream) watched() (map[string]bool, map[int]bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	feeds := make(map[string]bool)
+	threads := make(map[int]bool)
+	for sub := range st.subscribers {
+		if sub.feed != "" {
+			feeds[sub.feed] = true
+		}
+		if sub.thread != 0 {
+			threads[sub.thread] = true
+		}
+	}
+	return feeds, threads
+}
+
+// publish hands event to every interested subscriber. Subscribers that are
+// not keeping up miss the event rather than stalling the poller.
+func (st *storyStream) publish(name string, payload any, route streamEvent) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("stream event encode failed event=%s: %v", name, err)
+		return
+	}
+	route.name = name
+	route.data = data
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nextID++
+	route.id = st.nextID
+	for sub := range st.subscribers {
+		if !sub.wants(route) {
+			continue
+		}
+		select {
+		case sub.events <- route:
+		default:
+		}
+	}
+}
+
+func (st *storyStream) run(ctx context.Context) {
+	p := &streamPoller{
+		st:        st,
+		snapshots: make(map[int]storySnapshot),
+		rootOf:    make(map[int]int),
+	}
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	for {
+		p.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *streamPoller) poll(ctx context.Context) {
+	pollCtx, cancel := context.WithTimeout(ctx, streamPollInterval)
+	defer cancel()
+
+	feeds, threads := p.st.watched()
+	if err := p.pollNewItems(pollCtx, threads); err != nil && ctx.Err() == nil {
+		log.Printf("stream maxitem poll failed: %v", err)
+	}
+	if err := p.pollUpdates(pollCtx, feeds, threads); err != nil && ctx.Err() == nil {
+		log.Printf("stream updates poll failed: %v", err)
+	}
+}
+
+// pollNewItems publishes stories and watched-thread comments created since
+// the previous poll. The first poll only records the starting point.
+func (p *streamPoller) pollNewItems(ctx context.Context, threads map[int]bool) error {
+	var maxItem int
+	if err := p.st.s.fetchFirebaseJSON(ctx, "maxitem.json", &maxItem); err != nil {
+		return err
+	}
+	if p.lastMaxItem == 0 || maxItem <= p.lastMaxItem {
+		if p.lastMaxItem == 0 {
+			p.lastMaxItem = maxItem
+		}
+		return nil
+	}
+
+	from := p.lastMaxItem + 1
+	if maxItem-from+1 > streamMaxNewItems {
+		from = maxItem - streamMaxNewItems + 1
+	}
+	ids := make([]int, 0, maxItem-from+1)
+	for id := from; id <= maxItem; id++ {
+		ids = append(ids, id)
+	}
+
+	items, err := p.st.s.fetchItemsConcurrently(ctx, ids)
+	if err != nil {
+		return err
+	}
+	p.lastMaxItem = maxItem
+
+	for _, item := range items {
+		if item == nil || item.Deleted || item.Dead {
+			continue
+		}
+		switch item.Type {
+		case "story", "job", "poll":
+			p.st.publish("story", toStoryResponse(item), streamEvent{storyID: item.ID})
+		case "comment":
+			if len(threads) == 0 {
+				continue
+			}
+			root := p.resolveRoot(ctx, item)
+			if !threads[root] {
+				continue
+			}
+			p.st.publish("comment", streamComment{
+				StoryID: root,
+				Parent:  item.Parent,
+				Comment: toCommentResponse(item),
+			}, streamEvent{storyID: root, threadOnly: true})
+		}
+	}
+	return nil
+}
+
+// resolveRoot walks a comment's parent chain to its story, remembering each
+// hop so later comments in the same thread resolve without refetching.
+func (p *streamPoller) resolveRoot(ctx context.Context, item *hnItem) int {
+	if len(p.rootOf) > streamRootCacheMax {
+		p.rootOf = make(map[int]int)
+	}
+
+	chain := []int{item.ID}
+	parent := item.Parent
+	root := 0
+	for hops := 0; parent != 0 && hops < streamMaxParentHops; hops++ {
+		if known, ok := p.rootOf[parent]; ok {
+			root = known
+			break
+		}
+		parentItem, err := p.st.s.fetchItem(ctx, parent)
+		if err != nil || parentItem == nil {
+			return 0
+		}
+		if parentItem.Type != "comment" {
+			root = parentItem.ID
+			break
+		}
+		chain = append(chain, parentItem.ID)
+		parent = parentItem.Parent
+	}
+	if root == 0 {
+		return 0
+	}
+	for _, id := range chain {
+		p.rootOf[id] = root
+	}
+	return root
+}
+
+// pollUpdates publishes score and comment-count changes for stories that are
+// on a watched feed or are a watched thread.
+func (p *streamPoller) pollUpdates(ctx context.Context, feeds map[string]bool, threads map[int]bool) error {
+	if len(feeds) == 0 && len(threads) == 0 {
+		p.snapshots = make(map[int]storySnapshot)
+		return nil
+	}
+
+	storyFeeds := make(map[int]map[string]bool)
+	for feedName := range feeds {
+		ids, err := p.st.s.fetchStoryIDs(ctx, feedName)
+		if err != nil {
+			log.Printf("stream feed list fetch failed feed=%s: %v", feedName, err)
+			continue
+		}
+		for _, id := range ids {
+			if storyFeeds[id] == nil {
+				storyFeeds[id] = make(map[string]bool)
+			}
+			storyFeeds[id][feedName] = true
+		}
+	}
+	for id := range threads {
+		if storyFeeds[id] == nil {
+			storyFeeds[id] = make(map[string]bool)
+		}
+	}
+	for id := range p.snapshots {
+		if _, ok := storyFeeds[id]; !ok {
+			delete(p.snapshots, id)
+		}
+	}
+	p.seedSnapshots(ctx, storyFeeds)
+
+	updates, err := p.st.s.fetchUpdates(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range updates.Items {
+		memberOf, ok := storyFeeds[id]
+		if !ok {
+			continue
+		}
+		previous, known := p.snapshots[id]
+
+		item, err := p.st.s.loadItem(ctx, id)
+		if err != nil {
+			log.Printf("stream story refresh failed id=%d: %v", id, err)
+			continue
+		}
+		if item == nil {
+			continue
+		}
+		current := storySnapshot{score: item.Score, descendants: item.Descendants}
+		p.snapshots[id] = current
+		if !known || current == previous {
+			continue
+		}
+
+		feedList := make([]string, 0, len(memberOf))
+		for _, feed := range feedRegistry {
+			if memberOf[feed.name] {
+				feedList = append(feedList, feed.name)
+			}
+		}
+		p.st.publish("story_update", streamStoryUpdate{
+			ID:          item.ID,
+			Score:       item.Score,
+			Descendants: item.Descendants,
+			Feeds:       feedList,
+		}, streamEvent{storyID: item.ID, feeds: memberOf})
+	}
+	return nil
+}
+
+// seedSnapshots records the baseline of every story that has just entered a
+// watched feed or thread. The baseline has to be taken here, before the story
+// shows up in updates.json: by then the updates watcher may already have
+// refreshed the shared cache, and diffing against that copy would hide the
+// change.
+func (p *streamPoller) seedSnapshots(ctx context.Context, storyFeeds map[int]map[string]bool) {
+	var unseen []int
+	for id := range storyFeeds {
+		if _, ok := p.snapshots[id]; !ok {
+			unseen = append(unseen, id)
+		}
+	}
+	if len(unseen) == 0 {
+		return
+	}
+	items, err := p.st.s.fetchItemsConcurrently(ctx, unseen)
+	if err != nil {
+		log.Printf("stream snapshot seeding failed: %v", err)
+		return
+	}
+	for _, item := range items {
+		if item != nil {
+			p.snapshots[item.ID] = storySnapshot{score: item.Score, descendants: item.Descendants}
+		}
+	}
+}
+
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	feedName := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("feed")))
+	if feedName != "" {
+		if _, ok := lookupFeed(feedName); !ok {
+			writeError(w, http.StatusBadRequest, "feed must be one of: "+strings.Join(feedNames(), ", "))
+			return
+		}
+	}
+	thread := 0
+	if rawThread := strings.TrimSpace(r.URL.Query().Get("thread")); rawThread != "" {
+		id, ok := parseID(rawThread)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid thread parameter")
+			return
+		}
+		thread = id
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	sub := s.stream.subscribe(feedName, thread)
+	defer s.stream.unsubscribe(sub)
+
+	w.Header().Set(contentTypeHeader, eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryMillis)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatEvery)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-sub.events:
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.name, event.data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
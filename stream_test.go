@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestStreamResolveRoot(t *testing.T) {
+	s, fb := newFakeFirebaseServer(t, append(threadFixture(), comment(500, 499, "orphan"))...)
+	p := &streamPoller{st: newStoryStream(s), rootOf: make(map[int]int)}
+	ctx := context.Background()
+
+	if root := p.resolveRoot(ctx, comment(112, 111, "x")); root != 1 {
+		t.Fatalf("root of 112 = %d, want 1", root)
+	}
+	for _, id := range []int{112, 111, 11, 10} {
+		if p.rootOf[id] != 1 {
+			t.Errorf("rootOf[%d] = %d, want 1", id, p.rootOf[id])
+		}
+	}
+
+	// Known hops are not fetched again.
+	fb.setFailing(10, true)
+	if root := p.resolveRoot(ctx, comment(13, 10, "x")); root != 1 {
+		t.Errorf("root of 13 through a remembered parent = %d, want 1", root)
+	}
+	if root := p.resolveRoot(ctx, comment(91, 90, "x")); root != 2 {
+		t.Errorf("root of 91 = %d, want 2", root)
+	}
+	if root := p.resolveRoot(ctx, comment(501, 500, "x")); root != 0 {
+		t.Errorf("root of a comment whose chain breaks = %d, want 0", root)
+	}
+	if _, ok := p.rootOf[500]; ok {
+		t.Error("an unresolved chain was remembered")
+	}
+}
+
+func TestStreamPollerEvents(t *testing.T) {
+	s, fb := newFakeFirebaseServer(t, threadFixture()...)
+	fb.setDoc("topstories.json", []int{1})
+	fb.setDoc("maxitem.json", 111)
+	fb.setDoc("updates.json", firebaseUpdates{})
+
+	st := newStoryStream(s)
+	sub := &streamSubscriber{feed: "top", thread: 1, events: make(chan streamEvent, 8)}
+	bystander := &streamSubscriber{feed: "new", events: make(chan streamEvent, 8)}
+	st.subscribers[sub] = struct{}{}
+	st.subscribers[bystander] = struct{}{}
+	p := &streamPoller{st: st, snapshots: make(map[int]storySnapshot), rootOf: make(map[int]int)}
+	ctx := context.Background()
+
+	p.poll(ctx)
+	if len(sub.events) != 0 {
+		t.Fatalf("first poll published %d events, want only a baseline", len(sub.events))
+	}
+
+	// The story gains points and a reply. The updates watcher gets to the
+	// shared cache first, which must not hide the change from the stream.
+	story := *threadFixture()[0]
+	story.Score, story.Descendants = 50, 8
+	fb.setItem(&story)
+	fb.setItem(comment(112, 11, "erin"))
+	fb.setDoc("maxitem.json", 112)
+	fb.setDoc("updates.json", firebaseUpdates{Items: []int{1}})
+	if _, err := s.loadItem(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	s.cache.Delete(updatesCacheKey)
+
+	p.poll(ctx)
+	got := make(map[string]streamEvent)
+	for len(sub.events) > 0 {
+		event := <-sub.events
+		got[event.name] = event
+	}
+
+	var update streamStoryUpdate
+	if event, ok := got["story_update"]; !ok {
+		t.Fatal("no story_update event")
+	} else if err := json.Unmarshal(event.data, &update); err != nil || update.Score != 50 || update.Descendants != 8 || len(update.Feeds) != 1 || update.Feeds[0] != "top" {
+		t.Errorf("story_update = %s", event.data)
+	}
+	var reply streamComment
+	if event, ok := got["comment"]; !ok {
+		t.Fatal("no comment event")
+	} else if err := json.Unmarshal(event.data, &reply); err != nil || reply.StoryID != 1 || reply.Parent != 11 || reply.Comment.ID != 112 {
+		t.Errorf("comment = %s", event.data)
+	}
+	if len(bystander.events) != 0 {
+		t.Errorf("subscriber to another feed got %d events", len(bystander.events))
+	}
+
+	// Nothing changed since: no further update.
+	s.cache.Delete(updatesCacheKey)
+	p.poll(ctx)
+	for len(sub.events) > 0 {
+		if event := <-sub.events; event.name == "story_update" {
+			t.Errorf("unchanged story published %s", event.data)
+		}
+	}
+}
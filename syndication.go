@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syndicationPathPrefix = "/feed/"
+	hnItemURL             = "https://news.ycombinator.com/item?id="
+	rssContentType        = "application/rss+xml; charset=utf-8"
+	atomContentType       = "application/atom+xml; charset=utf-8"
+	jsonFeedContentType   = "application/feed+json; charset=utf-8"
+	jsonFeedVersion       = "https://jsonfeed.org/version/1.1"
+	syndicationGenerator  = "hn-cache-aggregator"
+)
+
+// syndicationFormat renders a page of stories for feed readers. Formats are
+// selected by path extension (/feed/top.rss) or, for an extensionless path,
+// by the request's Accept header.
+type syndicationFormat struct {
+	name      string
+	ext       string
+	mediaType string
+	render    func(channel syndicationChannel, stories []storyResponse) ([]byte, error)
+}
+
+var syndicationFormats = []syndicationFormat{
+	{name: "rss", ext: ".rss", mediaType: rssContentType, render: renderRSS},
+	{name: "atom", ext: ".atom", mediaType: atomContentType, render: renderAtom},
+	{name: "json", ext: ".json", mediaType: jsonFeedContentType, render: renderJSONFeed},
+}
+
+type syndicationChannel struct {
+	feed    feedSpec
+	selfURL string
+	// id is the canonical feed URL: scheme, host and path with the format's
+	// extension, but no query, so limit= and friends don't mint a new feed.
+	id      string
+	siteURL string
+	updated time.Time
+}
+
+func lookupSyndicationFormat(ext string) (syndicationFormat, bool) {
+	for _, format := range syndicationFormats {
+		if format.ext == ext {
+			return format, true
+		}
+	}
+	return syndicationFormat{}, false
+}
+
+// negotiateSyndicationFormat picks the format with the highest q-value in
+// accept and falls back to RSS when none is named.
+func negotiateSyndicationFormat(accept string) syndicationFormat {
+	type candidate struct {
+		format syndicationFormat
+		q      float64
+	}
+	var best *candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if rawQ, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(rawQ, 64); err == nil {
+				q = parsed
+			}
+		}
+		for _, format := range syndicationFormats {
+			formatType, _, _ := mime.ParseMediaType(format.mediaType)
+			if mediaType != formatType || q <= 0 {
+				continue
+			}
+			if best == nil || q > best.q {
+				best = &candidate{format: format, q: q}
+			}
+		}
+	}
+	if best == nil {
+		return syndicationFormats[0]
+	}
+	return best.format
+}
+
+func (s *server) handleSyndication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, syndicationPathPrefix))
+	var format syndicationFormat
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		var ok bool
+		format, ok = lookupSyndicationFormat(name[dot:])
+		if !ok {
+			writeError(w, http.StatusNotFound, "feed format must be one of: .rss, .atom, .json")
+			return
+		}
+		name = name[:dot]
+	} else {
+		format = negotiateSyndicationFormat(r.Header.Get("Accept"))
+		w.Header().Add(varyHeader, "Accept")
+	}
+
+	feed, ok := lookupFeed(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "feed must be one of: "+strings.Join(feedNames(), ", "))
+		return
+	}
+
+	limit := defaultStoriesLimit
+	if rawLimit := strings.TrimSpace(r.URL.Query().Get("limit")); rawLimit != "" {
+		parsedLimit, err := strconv.Atoi(rawLimit)
+		if err != nil || parsedLimit <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if parsedLimit > feed.maxItems {
+			parsedLimit = feed.maxItems
+		}
+		limit = parsedLimit
+	}
+
+	stories, err := s.getStoriesPage(r.Context(), feed.name, 0, limit)
+	if err != nil {
+		log.Printf("syndication fetch failed for feed=%s format=%s: %v", feed.name, format.name, err)
+		writeError(w, http.StatusBadGateway, "failed to hydrate stories")
+		return
+	}
+
+	siteURL := requestOrigin(r)
+	channel := syndicationChannel{
+		feed:    feed,
+		selfURL: siteURL + r.URL.RequestURI(),
+		id:      siteURL + syndicationPathPrefix + feed.name + format.ext,
+		siteURL: siteURL + "/",
+		updated: latestStoryTime(stories),
+	}
+	body, err := format.render(channel, stories)
+	if err != nil {
+		log.Printf("syndication render failed for feed=%s format=%s: %v", feed.name, format.name, err)
+		writeError(w, http.StatusInternalServerError, "failed to render feed")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60, stale-while-revalidate=30")
+	writeBodyConditional(w, r, http.StatusOK, format.mediaType, body)
+}
+
+// requestOrigin reconstructs the scheme and host the client used, honoring
+// X-Forwarded-Proto from the fronting proxy.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")); proto == "https" || proto == "http" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func latestStoryTime(stories []storyResponse) time.Time {
+	var latest int64
+	for _, story := range stories {
+		if story.Time > latest {
+			latest = story.Time
+		}
+	}
+	if latest == 0 {
+		return time.Now().UTC()
+	}
+	return time.Unix(latest, 0).UTC()
+}
+
+func storyThreadURL(story storyResponse) string {
+	return hnItemURL + strconv.Itoa(story.ID)
+}
+
+// storyLink is the article URL, or the HN thread for text posts.
+func storyLink(story storyResponse) string {
+	if story.URL != "" {
+		return story.URL
+	}
+	return storyThreadURL(story)
+}
+
+func storySummary(story storyResponse) string {
+	parts := make([]string, 0, 4)
+	if story.Domain != "" {
+		parts = append(parts, story.Domain)
+	}
+	parts = append(parts, fmt.Sprintf("%d points", story.Score))
+	if story.By != "" {
+		parts = append(parts, "by "+story.By)
+	}
+	parts = append(parts, fmt.Sprintf("%d comments", story.Descendants))
+	return strings.Join(parts, " | ")
+}
+
+func storySummaryHTML(story storyResponse) string {
+	var b strings.Builder
+	b.WriteString("<p>")
+	b.WriteString(xmlEscape(storySummary(story)))
+	b.WriteString(`</p><p><a href="`)
+	b.WriteString(xmlEscape(storyThreadURL(story)))
+	b.WriteString(`">Comments</a></p>`)
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func feedTitle(feed feedSpec) string {
+	return "Hacker News: " + feed.name
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	HN      string     `xml:"xmlns:hn,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	AtomLink      rssSelf    `xml:"atom:link"`
+	Generator     string     `xml:"generator"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	TTL           int        `xml:"ttl"`
+	Items         []rssEntry `xml:"item"`
+}
+
+type rssSelf struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEntry struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	CommentsURL string  `xml:"comments"`
+	Description string  `xml:"description"`
+	Author      string  `xml:"dc:creator,omitempty"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+	Domain      string  `xml:"hn:domain,omitempty"`
+	Score       int     `xml:"hn:score"`
+	Comments    int     `xml:"hn:comments"`
+}
+
+func renderRSS(channel syndicationChannel, stories []storyResponse) ([]byte, error) {
+	items := make([]rssEntry, 0, len(stories))
+	for _, story := range stories {
+		items = append(items, rssEntry{
+			Title:       story.Title,
+			Link:        storyLink(story),
+			CommentsURL: storyThreadURL(story),
+			Description: storySummaryHTML(story),
+			Author:      story.By,
+			PubDate:     time.Unix(story.Time, 0).UTC().Format(time.RFC1123Z),
+			GUID:        rssGUID{IsPermaLink: true, Value: storyThreadURL(story)},
+			Domain:      story.Domain,
+			Score:       story.Score,
+			Comments:    story.Descendants,
+		})
+	}
+
+	doc := rssDocument{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		HN:      "https://news.ycombinator.com/",
+		Channel: rssChannel{
+			Title:         feedTitle(channel.feed),
+			Link:          channel.siteURL,
+			Description:   "Hacker News " + channel.feed.name + " stories",
+			AtomLink:      rssSelf{Href: channel.selfURL, Rel: "self", Type: "application/rss+xml"},
+			Generator:     syndicationGenerator,
+			LastBuildDate: channel.updated.Format(time.RFC1123Z),
+			TTL:           int(channel.feed.listTTL.Minutes()),
+			Items:         items,
+		},
+	}
+	return marshalXMLDocument(doc)
+}
+
+type atomDocument struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	HN      string      `xml:"xmlns:hn,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Gen     string      `xml:"generator"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Links     []atomLink  `xml:"link"`
+	Author    *atomAuthor `xml:"author,omitempty"`
+	Summary   atomContent `xml:"summary"`
+	Domain    string      `xml:"hn:domain,omitempty"`
+	Score     int         `xml:"hn:score"`
+	Comments  int         `xml:"hn:comments"`
+}
+
+func renderAtom(channel syndicationChannel, stories []storyResponse) ([]byte, error) {
+	entries := make([]atomEntry, 0, len(stories))
+	for _, story := range stories {
+		published := time.Unix(story.Time, 0).UTC().Format(time.RFC3339)
+		entry := atomEntry{
+			ID:        storyThreadURL(story),
+			Title:     story.Title,
+			Updated:   published,
+			Published: published,
+			Links: []atomLink{
+				{Href: storyLink(story), Rel: "alternate"},
+				{Href: storyThreadURL(story), Rel: "replies", Type: "text/html"},
+			},
+			Summary:  atomContent{Type: "html", Value: storySummaryHTML(story)},
+			Domain:   story.Domain,
+			Score:    story.Score,
+			Comments: story.Descendants,
+		}
+		if story.By != "" {
+			entry.Author = &atomAuthor{Name: story.By}
+		}
+		entries = append(entries, entry)
+	}
+
+	doc := atomDocument{
+		HN:      "https://news.ycombinator.com/",
+		ID:      channel.id,
+		Title:   feedTitle(channel.feed),
+		Updated: channel.updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: channel.selfURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: channel.siteURL, Rel: "alternate"},
+		},
+		Gen:     syndicationGenerator,
+		Entries: entries,
+	}
+	return marshalXMLDocument(doc)
+}
+
+func marshalXMLDocument(doc any) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&body)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	body.WriteByte('\n')
+	return body.Bytes(), nil
+}
+
+type jsonFeedDocument struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	ExternalURL   string           `json:"external_url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHTML   string           `json:"content_html"`
+	Summary       string           `json:"summary,omitempty"`
+	DatePublished string           `json:"date_published"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	HN            jsonFeedHN       `json:"_hn"`
+}
+
+// jsonFeedHN is a JSON Feed extension object; the leading underscore marks it
+// as custom per the spec.
+type jsonFeedHN struct {
+	ID        int    `json:"id"`
+	Domain    string `json:"domain,omitempty"`
+	Score     int    `json:"score"`
+	Comments  int    `json:"comments"`
+	ThreadURL string `json:"thread_url"`
+}
+
+func renderJSONFeed(channel syndicationChannel, stories []storyResponse) ([]byte, error) {
+	items := make([]jsonFeedItem, 0, len(stories))
+	for _, story := range stories {
+		item := jsonFeedItem{
+			ID:            strconv.Itoa(story.ID),
+			URL:           storyThreadURL(story),
+			ExternalURL:   story.URL,
+			Title:         story.Title,
+			ContentHTML:   storySummaryHTML(story),
+			Summary:       storySummary(story),
+			DatePublished: time.Unix(story.Time, 0).UTC().Format(time.RFC3339),
+			HN: jsonFeedHN{
+				ID:        story.ID,
+				Domain:    story.Domain,
+				Score:     story.Score,
+				Comments:  story.Descendants,
+				ThreadURL: storyThreadURL(story),
+			},
+		}
+		if story.By != "" {
+			item.Authors = []jsonFeedAuthor{{Name: story.By}}
+		}
+		items = append(items, item)
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(jsonFeedDocument{
+		Version:     jsonFeedVersion,
+		Title:       feedTitle(channel.feed),
+		HomePageURL: channel.siteURL,
+		FeedURL:     channel.selfURL,
+		Description: "Hacker News " + channel.feed.name + " stories",
+		Items:       items,
+	}); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
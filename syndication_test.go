@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getSyndication(t *testing.T, s *server, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Host = "hn.example"
+	rec := httptest.NewRecorder()
+	s.handleSyndication(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d: %s", target, rec.Code, rec.Body)
+	}
+	return rec
+}
+
+func newSyndicationServer(t *testing.T) *server {
+	t.Helper()
+	s, fb := newFakeFirebaseServer(t, threadFixture()...)
+	fb.setDoc("topstories.json", []int{1, 2})
+	return s
+}
+
+func TestSyndicationRSS(t *testing.T) {
+	rec := getSyndication(t, newSyndicationServer(t), "/feed/top.rss?limit=5")
+	if got := rec.Header().Get(contentTypeHeader); got != rssContentType {
+		t.Errorf("content type = %q", got)
+	}
+	var doc struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel struct {
+			Title string `xml:"title"`
+			// Both <link> and <atom:link> land here; the second carries the
+			// Atom namespace.
+			Links []struct {
+				XMLName xml.Name
+				Href    string `xml:"href,attr"`
+				Value   string `xml:",chardata"`
+			} `xml:"link"`
+			LastBuildDate string `xml:"lastBuildDate"`
+			Items         []struct {
+				Title   string `xml:"title"`
+				Link    string `xml:"link"`
+				GUID    string `xml:"guid"`
+				PubDate string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, rec.Body)
+	}
+	if doc.Version != "2.0" || doc.Channel.Title != "Hacker News: top" {
+		t.Errorf("channel = %+v", doc.Channel)
+	}
+	for _, link := range doc.Channel.Links {
+		switch link.XMLName.Space {
+		case "":
+			if link.Value != "http://hn.example/" {
+				t.Errorf("link = %q", link.Value)
+			}
+		case "http://www.w3.org/2005/Atom":
+			if link.Href != "http://hn.example/feed/top.rss?limit=5" {
+				t.Errorf("atom:link = %q", link.Href)
+			}
+		}
+	}
+	if len(doc.Channel.Links) != 2 {
+		t.Errorf("channel links = %+v", doc.Channel.Links)
+	}
+	if _, err := time.Parse(time.RFC1123Z, doc.Channel.LastBuildDate); err != nil {
+		t.Errorf("lastBuildDate: %v", err)
+	}
+	if len(doc.Channel.Items) != 2 {
+		t.Fatalf("items = %d, want 2", len(doc.Channel.Items))
+	}
+	first := doc.Channel.Items[0]
+	if first.Title != "Story" || first.GUID != hnItemURL+"1" || first.Link != hnItemURL+"1" {
+		t.Errorf("first item = %+v", first)
+	}
+	if _, err := time.Parse(time.RFC1123Z, first.PubDate); err != nil {
+		t.Errorf("pubDate: %v", err)
+	}
+}
+
+func TestSyndicationAtom(t *testing.T) {
+	rec := getSyndication(t, newSyndicationServer(t), "/feed/top.atom?limit=5")
+	var doc struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string   `xml:"id"`
+		Updated string   `xml:"updated"`
+		Links   []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Entries []struct {
+			ID      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, rec.Body)
+	}
+	if doc.ID != "http://hn.example/feed/top.atom" {
+		t.Errorf("feed id = %q, want the feed URL without its query", doc.ID)
+	}
+	if _, err := time.Parse(time.RFC3339, doc.Updated); err != nil {
+		t.Errorf("feed updated: %v", err)
+	}
+	if len(doc.Links) == 0 || doc.Links[0].Rel != "self" || doc.Links[0].Href != "http://hn.example/feed/top.atom?limit=5" {
+		t.Errorf("links = %+v", doc.Links)
+	}
+	if len(doc.Entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(doc.Entries))
+	}
+	for _, entry := range doc.Entries {
+		if entry.ID == "" || entry.Title == "" {
+			t.Errorf("entry = %+v", entry)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry updated: %v", err)
+		}
+	}
+
+	// The negotiated form of the same feed keeps the same id.
+	req := httptest.NewRequest(http.MethodGet, "/feed/top", nil)
+	req.Host = "hn.example"
+	req.Header.Set("Accept", "application/atom+xml")
+	negotiated := httptest.NewRecorder()
+	newSyndicationServer(t).handleSyndication(negotiated, req)
+	if !strings.Contains(negotiated.Body.String(), "<id>http://hn.example/feed/top.atom</id>") {
+		t.Errorf("negotiated Atom feed lacks the canonical id:\n%s", negotiated.Body)
+	}
+}
+
+func TestSyndicationJSONFeed(t *testing.T) {
+	rec := getSyndication(t, newSyndicationServer(t), "/feed/top.json")
+	if got := rec.Header().Get(contentTypeHeader); got != jsonFeedContentType {
+		t.Errorf("content type = %q", got)
+	}
+	var doc struct {
+		Version string `json:"version"`
+		Title   string `json:"title"`
+		FeedURL string `json:"feed_url"`
+		Items   []struct {
+			ID            string `json:"id"`
+			URL           string `json:"url"`
+			ContentHTML   string `json:"content_html"`
+			DatePublished string `json:"date_published"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, rec.Body)
+	}
+	if doc.Version != jsonFeedVersion || doc.FeedURL != "http://hn.example/feed/top.json" {
+		t.Errorf("feed = %+v", doc)
+	}
+	if len(doc.Items) != 2 || doc.Items[0].ID != "1" || doc.Items[0].ContentHTML == "" {
+		t.Fatalf("items = %+v", doc.Items)
+	}
+	if _, err := time.Parse(time.RFC3339, doc.Items[0].DatePublished); err != nil {
+		t.Errorf("date_published: %v", err)
+	}
+}
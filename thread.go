@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// threadMaxAncestors bounds the walk from a comment up to its story; HN
+	// threads are never nested anywhere near this deep.
+	threadMaxAncestors = 256
+	threadRetryMaxIDs  = 100
+	threadTimeout      = 45 * time.Second
+	ndjsonContentType  = "application/x-ndjson"
+)
+
+var errNotInThread = errors.New("comment is not part of this thread")
+
+// threadOptions select the part of a comment tree one /api/thread request
+// hydrates. Replies are listed under parent, which is the story unless the
+// client is expanding a comment, starting at offset and at most limit of
+// them. Each listed reply is expanded maxDepth levels deep, counting itself.
+// Zero limit or maxDepth means no bound.
+type threadOptions struct {
+	parent   int
+	offset   int
+	limit    int
+	maxDepth int
+}
+
+// parseThreadOptions reads the depth, limit, parent and cursor parameters.
+// The returned message is suitable for a 400 response.
+func parseThreadOptions(query url.Values) (threadOptions, string) {
+	var opts threadOptions
+	positive := map[string]*int{"depth": &opts.maxDepth, "limit": &opts.limit}
+	for name, dst := range positive {
+		raw := strings.TrimSpace(query.Get(name))
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			return opts, name + " must be a positive integer"
+		}
+		*dst = parsed
+	}
+	if raw := strings.TrimSpace(query.Get("parent")); raw != "" {
+		parent, ok := parseID(raw)
+		if !ok {
+			return opts, "invalid parent parameter"
+		}
+		opts.parent = parent
+	}
+	if raw := strings.TrimSpace(query.Get("cursor")); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return opts, "invalid cursor parameter"
+		}
+		opts.offset = offset
+	}
+	return opts, ""
+}
+
+// page cuts ids to the window opts selects and returns the cursor of the
+// next window, or "" when ids are exhausted.
+func (opts threadOptions) page(ids []int) ([]int, string) {
+	if opts.offset >= len(ids) {
+		return []int{}, ""
+	}
+	ids = ids[opts.offset:]
+	if opts.limit == 0 || opts.limit >= len(ids) {
+		return ids, ""
+	}
+	return ids[:opts.limit], strconv.Itoa(opts.offset + opts.limit)
+}
+
+// fetchThreadComment returns the comment id after checking that its chain of
+// parents leads to storyID, so a cursor cannot splice another discussion
+// into this thread.
+func (s *server) fetchThreadComment(ctx context.Context, storyID int, id int) (*hnItem, error) {
+	comment, err := s.fetchItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if comment == nil || comment.Type != "comment" {
+		return nil, errNotInThread
+	}
+	ancestor := comment
+	for i := 0; i < threadMaxAncestors; i++ {
+		if ancestor.Parent == storyID {
+			return comment, nil
+		}
+		if ancestor.Parent == 0 {
+			break
+		}
+		ancestor, err = s.fetchItem(ctx, ancestor.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if ancestor == nil || ancestor.Type != "comment" {
+			break
+		}
+	}
+	return nil, errNotInThread
+}
+
+// wantsThreadStream reports whether the client asked for the thread as
+// NDJSON, with format=ndjson or by listing that type first in Accept.
+func wantsThreadStream(r *http.Request) (bool, string) {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format"))) {
+	case "ndjson":
+		return true, ""
+	case "json":
+		return false, ""
+	case "":
+		return strings.HasPrefix(strings.TrimSpace(r.Header.Get("Accept")), ndjsonContentType), ""
+	default:
+		return false, "format must be one of: json, ndjson"
+	}
+}
+
+// threadStreamRecord is one line of an NDJSON thread. A "story" record comes
+// first, then a "comment" record per comment as it is fetched, always after
+// its parent's, and an "end" record closes the stream. Comments that failed
+// to load are sent as placeholders and listed again in the end record.
+type threadStreamRecord struct {
+	Record     string           `json:"record"`
+	Story      *storyResponse   `json:"story,omitempty"`
+	Comment    *streamedComment `json:"comment,omitempty"`
+	Parent     int              `json:"parent,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	Partial    bool             `json:"partial,omitempty"`
+	FailedIDs  []int            `json:"failed_ids,omitempty"`
+}
+
+// streamedComment is a comment without its nested replies, which arrive as
+// records of their own, placed by its parent ID and its position among the
+// parent's replies.
+type streamedComment struct {
+	*commentResponse
+	// Kids is never set; it hides the nested replies of commentResponse.
+	Kids     []*commentResponse `json:"kids,omitempty"`
+	Parent   int                `json:"parent"`
+	Position int                `json:"position"`
+	Depth    int                `json:"depth"`
+}
+
+// streamThread writes the thread as NDJSON, flushing every record so clients
+// render comments while the rest of the tree is still being fetched.
+func (s *server) streamThread(ctx context.Context, w http.ResponseWriter, story *hnItem, opts threadOptions, replies []int, nextCursor string, walk *commentWalk) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	write := func(record threadStreamRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := encoder.Encode(record); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+
+	header := toStoryResponse(story)
+	first := threadStreamRecord{Record: "story", Story: &header}
+	if opts.parent != story.ID {
+		first.Parent = opts.parent
+	}
+	write(first)
+
+	walk.emit = func(node *commentResponse, parent int, position int, depth int) {
+		write(threadStreamRecord{Record: "comment", Comment: &streamedComment{commentResponse: node, Parent: parent, Position: position, Depth: depth}})
+	}
+	if _, err := s.fetchCommentForest(ctx, replies, walk); err != nil {
+		log.Printf("thread stream hydration failed id=%d: %v", story.ID, err)
+	}
+	failed := walk.failures()
+	write(threadStreamRecord{Record: "end", NextCursor: nextCursor, Partial: len(failed) > 0, FailedIDs: failed})
+}
+
+// threadRetryResponse carries the subtrees asked for by ID, in request order,
+// for the client to splice over its placeholders.
+type threadRetryResponse struct {
+	ID        int                `json:"id"`
+	Comments  []*commentResponse `json:"comments"`
+	Partial   bool               `json:"partial"`
+	FailedIDs []int              `json:"failed_ids,omitempty"`
+}
+
+// handleThreadRetry re-hydrates the subtrees of a thread that failed to load,
+// given as the failed_ids of an earlier response, through the same depth and
+// view parameters as /api/thread.
+func (s *server) handleThreadRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set(allowHeader, http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	storyID, ok := parseID(r.URL.Query().Get("id"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid id parameter")
+		return
+	}
+	ids, ok := parseIDList(r.URL.Query().Get("ids"), threadRetryMaxIDs)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "ids must be a comma-separated list of at most "+strconv.Itoa(threadRetryMaxIDs)+" item IDs")
+		return
+	}
+	opts, problem := parseThreadOptions(r.URL.Query())
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+	view, problem := parseThreadView(r.URL.Query())
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), threadTimeout)
+	defer cancel()
+	if view.byOP {
+		story, err := s.fetchItem(ctx, storyID)
+		if err != nil {
+			log.Printf("thread retry story fetch failed id=%d: %v", storyID, err)
+			writeError(w, http.StatusBadGateway, "failed to fetch story")
+			return
+		}
+		if story == nil {
+			writeError(w, http.StatusNotFound, "story not found")
+			return
+		}
+		view.author = story.By
+	}
+	for _, id := range ids {
+		// A comment that fails to load again is reported below as still
+		// failed; only one that provably belongs elsewhere is refused.
+		if _, err := s.fetchThreadComment(ctx, storyID, id); errors.Is(err, errNotInThread) {
+			writeError(w, http.StatusBadRequest, "ids must be comments in this thread")
+			return
+		}
+	}
+
+	walk := &commentWalk{maxDepth: opts.maxDepth}
+	comments, err := s.fetchCommentForest(ctx, ids, walk)
+	if err != nil {
+		log.Printf("thread retry hydration failed id=%d: %v", storyID, err)
+		writeError(w, http.StatusBadGateway, "failed to hydrate comment tree")
+		return
+	}
+	comments = view.apply(comments)
+	failed := walk.failures()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, threadRetryResponse{ID: storyID, Comments: comments, Partial: len(failed) > 0, FailedIDs: failed})
+}
+
+// parseIDList reads a comma-separated list of 1 to max item IDs, dropping
+// repeats.
+func parseIDList(raw string, max int) ([]int, bool) {
+	fields := strings.Split(raw, ",")
+	if len(fields) > max {
+		return nil, false
+	}
+	var ids []int
+	seen := make(map[int]bool)
+	for _, field := range fields {
+		id, ok := parseID(field)
+		if !ok {
+			return nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, true
+}
+
+const (
+	threadOrderDefault = "default"
+	threadOrderNewest  = "newest"
+	threadOrderOldest  = "oldest"
+	threadOrderSize    = "size"
+)
+
+// threadView rearranges a hydrated comment tree. order sorts the replies
+// under every node, hideDead drops dead and deleted comments with nothing
+// live beneath them, and author and terms keep only the comments by that
+// user or containing every term, along with the ancestors that place them.
+// The view only sees the part of the tree that was loaded: a page is sorted
+// and filtered on its own, and replies past the depth limit are not searched.
+type threadView struct {
+	order    string
+	hideDead bool
+	byOP     bool
+	author   string
+	terms    []string
+}
+
+// parseThreadView reads the sort, hide_dead, op, by and q parameters. The
+// returned message is suitable for a 400 response. op is left for the caller
+// to resolve into author once the story is known.
+func parseThreadView(query url.Values) (threadView, string) {
+	var view threadView
+	switch order := strings.ToLower(strings.TrimSpace(query.Get("sort"))); order {
+	case "", threadOrderDefault:
+	case threadOrderNewest, threadOrderOldest, threadOrderSize:
+		view.order = order
+	default:
+		return view, "sort must be one of: default, newest, oldest, size"
+	}
+	flags := map[string]*bool{"hide_dead": &view.hideDead, "op": &view.byOP}
+	for name, dst := range flags {
+		raw := strings.TrimSpace(query.Get(name))
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return view, name + " must be a boolean"
+		}
+		*dst = parsed
+	}
+	view.author = strings.TrimSpace(query.Get("by"))
+	if view.byOP && view.author != "" {
+		return view, "op and by cannot be combined"
+	}
+	view.terms = strings.Fields(strings.ToLower(query.Get("q")))
+	return view, ""
+}
+
+func (view threadView) isZero() bool {
+	return view.order == "" && !view.hideDead && !view.byOP && view.author == "" && len(view.terms) == 0
+}
+
+func (view threadView) filtering() bool {
+	return view.author != "" || len(view.terms) > 0
+}
+
+// apply returns the nodes view keeps, in its order, having applied it to
+// their replies as well. Subtree size is taken from LoadedDescendants, so it
+// counts the replies a filter removes but not those below unexpanded ones.
+func (view threadView) apply(nodes []*commentResponse) []*commentResponse {
+	kept := make([]*commentResponse, 0, len(nodes))
+	for _, node := range nodes {
+		node.Kids = view.apply(node.Kids)
+		if view.keeps(node) {
+			kept = append(kept, node)
+		}
+	}
+
+	switch view.order {
+	case threadOrderNewest:
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].Time > kept[j].Time })
+	case threadOrderOldest:
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].Time < kept[j].Time })
+	case threadOrderSize:
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].LoadedDescendants > kept[j].LoadedDescendants })
+	}
+	return kept
+}
+
+// keeps reports whether node stays in the tree, given that its replies have
+// already been filtered. Placeholders for failed comments always stay, since
+// nothing is known about them.
+func (view threadView) keeps(node *commentResponse) bool {
+	if node.Failed {
+		return true
+	}
+	if view.filtering() {
+		node.Matched = view.matches(node)
+		if !node.Matched && len(node.Kids) == 0 {
+			return false
+		}
+	}
+	if view.hideDead && (node.Dead || node.Deleted) && len(node.Kids) == 0 && len(node.MoreKids) == 0 {
+		return false
+	}
+	return true
+}
+
+func (view threadView) matches(node *commentResponse) bool {
+	if view.author != "" && !strings.EqualFold(node.By, view.author) {
+		return false
+	}
+	if len(view.terms) == 0 {
+		return true
+	}
+	text := strings.ToLower(commentPlainText(node.Text))
+	for _, term := range view.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// commentPlainText returns the text of a sanitized comment body with its
+// markup removed, entities decoded and whitespace collapsed.
+func commentPlainText(body string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case html.TextToken:
+			b.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// Paragraph breaks separate words that have no space between
+			// them in the markup.
+			b.WriteByte(' ')
+		}
+	}
+}
+
+// summarize fills in the subtree statistics of node from its own fields and
+// those of its replies, which must already be summarized.
+func (node *commentResponse) summarize() {
+	node.authors = make(map[string]struct{})
+	if node.By != "" {
+		node.authors[node.By] = struct{}{}
+	}
+	node.LoadedDescendants = len(node.MoreKids)
+	if len(node.MoreKids) > 0 {
+		node.MaxDepth = 1
+	}
+	for _, kid := range node.Kids {
+		node.LoadedDescendants += 1 + kid.LoadedDescendants
+		node.MaxDepth = max(node.MaxDepth, 1+kid.MaxDepth)
+		node.NewestReply = max(node.NewestReply, kid.Time, kid.NewestReply)
+		for by := range kid.authors {
+			node.authors[by] = struct{}{}
+		}
+		kid.authors = nil
+	}
+	node.Participants = len(node.authors)
+}
+
+// threadTopParticipants bounds threadParticipants.Top.
+const threadTopParticipants = 10
+
+// threadParticipants describes who wrote the comments of a thread response.
+type threadParticipants struct {
+	Count      int `json:"count"`
+	Comments   int `json:"comments"`
+	OPComments int `json:"op_comments"`
+	// Top lists the most active authors, most comments first.
+	Top []participantCount `json:"top"`
+}
+
+type participantCount struct {
+	By       string `json:"by"`
+	Comments int    `json:"comments"`
+}
+
+// summarizeParticipants counts the comments each author wrote in the forest.
+// Placeholders and deleted comments, which have no author, are not counted.
+func summarizeParticipants(nodes []*commentResponse, op string) threadParticipants {
+	counts := make(map[string]int)
+	var walk func([]*commentResponse)
+	walk = func(nodes []*commentResponse) {
+		for _, node := range nodes {
+			if node.By != "" {
+				counts[node.By]++
+			}
+			walk(node.Kids)
+		}
+	}
+	walk(nodes)
+
+	stats := threadParticipants{Count: len(counts), Top: make([]participantCount, 0, len(counts))}
+	for by, n := range counts {
+		stats.Comments += n
+		stats.Top = append(stats.Top, participantCount{By: by, Comments: n})
+	}
+	if op != "" {
+		stats.OPComments = counts[op]
+	}
+	sort.Slice(stats.Top, func(i, j int) bool {
+		if stats.Top[i].Comments != stats.Top[j].Comments {
+			return stats.Top[i].Comments > stats.Top[j].Comments
+		}
+		return stats.Top[i].By < stats.Top[j].By
+	})
+	if len(stats.Top) > threadTopParticipants {
+		stats.Top = stats.Top[:threadTopParticipants]
+	}
+	return stats
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// fakeFirebase stands in for the HN API, serving items from a map and any
+// other document, such as a feed list, from docs.
+type fakeFirebase struct {
+	mu      sync.Mutex
+	items   map[int]*hnItem
+	docs    map[string]any
+	held    map[int]chan struct{}
+	failing map[int]bool
+}
+
+// setItem adds or replaces an item.
+func (f *fakeFirebase) setItem(item *hnItem) {
+	f.mu.Lock()
+	f.items[item.ID] = item
+	f.mu.Unlock()
+}
+
+// setDoc serves value as JSON at path, relative to /v0/.
+func (f *fakeFirebase) setDoc(path string, value any) {
+	f.mu.Lock()
+	f.docs[path] = value
+	f.mu.Unlock()
+}
+
+// hold makes requests for id wait until the returned release is called.
+func (f *fakeFirebase) hold(id int) (release func()) {
+	gate := make(chan struct{})
+	f.mu.Lock()
+	f.held[id] = gate
+	f.mu.Unlock()
+	return sync.OnceFunc(func() { close(gate) })
+}
+
+// setFailing makes requests for id answer 500 until it is called again with
+// false.
+func (f *fakeFirebase) setFailing(id int, failing bool) {
+	f.mu.Lock()
+	f.failing[id] = failing
+	f.mu.Unlock()
+}
+
+// newFakeFirebaseServer returns a server whose Firebase requests are all
+// answered by items.
+func newFakeFirebaseServer(t *testing.T, items ...*hnItem) (*server, *fakeFirebase) {
+	t.Helper()
+	fb := &fakeFirebase{items: make(map[int]*hnItem), docs: make(map[string]any), held: make(map[int]chan struct{}), failing: make(map[int]bool)}
+	for _, item := range items {
+		fb.items[item.ID] = item
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := strings.CutPrefix(r.URL.Path, "/v0/item/")
+		if !ok {
+			fb.mu.Lock()
+			doc, found := fb.docs[strings.TrimPrefix(r.URL.Path, "/v0/")]
+			fb.mu.Unlock()
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(doc)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(raw, ".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fb.mu.Lock()
+		item, gate, failing := fb.items[id], fb.held[id], fb.failing[id]
+		fb.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		if failing {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(item)
+	}))
+	t.Cleanup(upstream.Close)
+
+	target, _ := url.Parse(upstream.URL)
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	itemTTLs, _ := parseItemTTLPolicy("")
+	return &server{client: client, cache: newTTLRUCache(1024), flights: newFlightGroup(), itemTTLs: itemTTLs}, fb
+}
+
+func comment(id, parent int, by string, kids ...int) *hnItem {
+	return &hnItem{ID: id, Type: "comment", By: by, Parent: parent, Time: int64(1_700_000_000 + id), Text: "comment " + strconv.Itoa(id), Kids: kids}
+}
+
+// threadFixture is story 1 with this tree of replies:
+//
+//	10 ─┬─ 11 ── 111
+//	    └─ 12
+//	20
+//	30 ── 31
+//
+// Comment 90 belongs to another story.
+func threadFixture() []*hnItem {
+	return []*hnItem{
+		{ID: 1, Type: "story", By: "op", Title: "Story", Time: 1_700_000_000, Kids: []int{10, 20, 30}, Descendants: 7},
+		comment(10, 1, "alice", 11, 12),
+		comment(11, 10, "op", 111),
+		comment(111, 11, "bob"),
+		comment(12, 10, "carol"),
+		comment(20, 1, "bob"),
+		comment(30, 1, "dave", 31),
+		comment(31, 30, "alice"),
+		{ID: 2, Type: "story", Title: "Other", Kids: []int{90}},
+		comment(90, 2, "erin"),
+	}
+}
+
+func getThread(t *testing.T, s *server, query string) (int, threadResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleThread(rec, httptest.NewRequest(http.MethodGet, "/api/thread?"+query, nil))
+	var thread threadResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &thread); err != nil {
+			t.Fatalf("decode thread: %v", err)
+		}
+	}
+	return rec.Code, thread
+}
+
+func commentIDs(nodes []*commentResponse) []int {
+	ids := []int{}
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+	return ids
+}
+
+func TestThreadPagination(t *testing.T) {
+	s, _ := newFakeFirebaseServer(t, threadFixture()...)
+
+	status, thread := getThread(t, s, "id=1&depth=1&limit=2")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{10, 20}) || thread.NextCursor != "2" {
+		t.Fatalf("first page = %v cursor %q, want [10 20] cursor 2", got, thread.NextCursor)
+	}
+	first := thread.Comments[0]
+	if len(first.Kids) != 0 || first.KidCount != 2 || !reflect.DeepEqual(first.MoreKids, []int{11, 12}) {
+		t.Fatalf("collapsed comment = kids %v count %d more %v", commentIDs(first.Kids), first.KidCount, first.MoreKids)
+	}
+
+	_, thread = getThread(t, s, "id=1&depth=1&limit=2&cursor="+thread.NextCursor)
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{30}) || thread.NextCursor != "" {
+		t.Fatalf("second page = %v cursor %q, want [30] and no cursor", got, thread.NextCursor)
+	}
+
+	_, thread = getThread(t, s, "id=1&parent=10&depth=1")
+	if got := commentIDs(thread.Comments); thread.Parent != 10 || !reflect.DeepEqual(got, []int{11, 12}) {
+		t.Fatalf("replies to 10 = %v parent %d", got, thread.Parent)
+	}
+	if !reflect.DeepEqual(thread.Comments[0].MoreKids, []int{111}) {
+		t.Fatalf("11 more_kids = %v, want [111]", thread.Comments[0].MoreKids)
+	}
+
+	_, thread = getThread(t, s, "id=1&depth=2")
+	if got := commentIDs(thread.Comments[0].Kids); !reflect.DeepEqual(got, []int{11, 12}) || thread.Comments[0].MoreKids != nil {
+		t.Fatalf("depth 2 expanded 10 to %v more %v", got, thread.Comments[0].MoreKids)
+	}
+
+	_, thread = getThread(t, s, "id=1")
+	if deepest := thread.Comments[0].Kids[0].Kids; len(deepest) != 1 || deepest[0].ID != 111 {
+		t.Fatalf("unbounded thread did not reach 111")
+	}
+}
+
+func TestThreadOptionErrors(t *testing.T) {
+	s, _ := newFakeFirebaseServer(t, threadFixture()...)
+	for _, query := range []string{"id=1&depth=0", "id=1&limit=-1", "id=1&cursor=x", "id=1&parent=abc", "id=1&parent=90", "id=1&parent=2"} {
+		if status, _ := getThread(t, s, query); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, status)
+		}
+	}
+	if status, _ := getThread(t, s, "id=1&parent=111"); status != http.StatusOK {
+		t.Errorf("deep parent: status = %d, want 200", status)
+	}
+}
+
+func TestThreadStream(t *testing.T) {
+	s, fb := newFakeFirebaseServer(t, threadFixture()...)
+	release := fb.hold(31)
+	defer release()
+
+	api := httptest.NewServer(gzipMiddleware(http.HandlerFunc(s.handleThread)))
+	defer api.Close()
+	resp, err := http.Get(api.URL + "/api/thread?id=1&format=ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !resp.Uncompressed || resp.Header.Get(contentTypeHeader) != ndjsonContentType {
+		t.Fatalf("response was not gzipped NDJSON: uncompressed=%v type=%q", resp.Uncompressed, resp.Header.Get(contentTypeHeader))
+	}
+
+	// streamedComment embeds an unexported pointer, which encoding/json
+	// cannot decode into, so records are read back through this shape.
+	type streamLine struct {
+		Record  string         `json:"record"`
+		Story   *storyResponse `json:"story"`
+		Comment *struct {
+			ID       int `json:"id"`
+			Parent   int `json:"parent"`
+			Position int `json:"position"`
+			Depth    int `json:"depth"`
+		} `json:"comment"`
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() streamLine {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("stream ended early: %v", lines.Err())
+		}
+		var record streamLine
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			t.Fatalf("decode %q: %v", lines.Text(), err)
+		}
+		return record
+	}
+
+	if first := next(); first.Record != "story" || first.Story == nil || first.Story.ID != 1 {
+		t.Fatalf("first record = %+v, want the story", first)
+	}
+
+	// Everything but 31 arrives while 31 is still held upstream, each after
+	// its parent.
+	seen := map[int]bool{1: true}
+	want := map[int][3]int{10: {1, 0, 1}, 11: {10, 0, 2}, 111: {11, 0, 3}, 12: {10, 1, 2}, 20: {1, 1, 1}, 30: {1, 2, 1}, 31: {30, 0, 2}}
+	for len(seen) < 7 {
+		record := next()
+		c := record.Comment
+		if record.Record != "comment" || c == nil {
+			t.Fatalf("record = %+v, want a comment", record)
+		}
+		if !seen[c.Parent] {
+			t.Errorf("comment %d arrived before its parent %d", c.ID, c.Parent)
+		}
+		if got := [3]int{c.Parent, c.Position, c.Depth}; got != want[c.ID] {
+			t.Errorf("comment %d placed at %v, want %v", c.ID, got, want[c.ID])
+		}
+		seen[c.ID] = true
+	}
+	if seen[31] {
+		t.Fatal("held comment 31 was streamed")
+	}
+
+	release()
+	if record := next(); record.Comment == nil || record.Comment.ID != 31 {
+		t.Fatalf("record = %+v, want comment 31", record)
+	}
+	if record := next(); record.Record != "end" {
+		t.Fatalf("record = %+v, want the end", record)
+	}
+}
+
+func TestThreadPartial(t *testing.T) {
+	s, fb := newFakeFirebaseServer(t, threadFixture()...)
+	fb.setFailing(11, true)
+	fb.setFailing(20, true)
+
+	rec := httptest.NewRecorder()
+	s.handleThread(rec, httptest.NewRequest(http.MethodGet, "/api/thread?id=1", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("status = %d cache-control %q, want 200 and no-store", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	var thread threadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &thread); err != nil {
+		t.Fatal(err)
+	}
+	if !thread.Partial || !reflect.DeepEqual(thread.FailedIDs, []int{11, 20}) {
+		t.Fatalf("partial = %v failed = %v, want true and [11 20]", thread.Partial, thread.FailedIDs)
+	}
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{10, 20, 30}) {
+		t.Fatalf("roots = %v, want placeholders kept in place", got)
+	}
+	if placeholder := thread.Comments[0].Kids[0]; placeholder.ID != 11 || !placeholder.Failed || len(placeholder.Kids) != 0 {
+		t.Fatalf("first reply to 10 = %+v, want a failed placeholder for 11", placeholder)
+	}
+	if thread.Comments[0].Kids[1].Failed || !thread.Comments[1].Failed || thread.Comments[2].Failed {
+		t.Fatal("failed flags are on the wrong comments")
+	}
+
+	fb.setFailing(11, false)
+	fb.setFailing(20, false)
+	_, thread = getThread(t, s, "id=1")
+	if thread.Partial || thread.FailedIDs != nil {
+		t.Fatalf("recovered thread partial = %v failed = %v", thread.Partial, thread.FailedIDs)
+	}
+}
+
+func TestThreadRetry(t *testing.T) {
+	s, fb := newFakeFirebaseServer(t, threadFixture()...)
+	retry := func(query string) (int, threadRetryResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleThreadRetry(rec, httptest.NewRequest(http.MethodGet, "/api/thread/retry?"+query, nil))
+		var resp threadRetryResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, resp
+	}
+
+	fb.setFailing(111, true)
+	status, resp := retry("id=1&ids=11,20")
+	if status != http.StatusOK || !resp.Partial || !reflect.DeepEqual(resp.FailedIDs, []int{111}) {
+		t.Fatalf("status = %d partial = %v failed = %v, want 200, true and [111]", status, resp.Partial, resp.FailedIDs)
+	}
+	if got := commentIDs(resp.Comments); !reflect.DeepEqual(got, []int{11, 20}) || !resp.Comments[0].Kids[0].Failed {
+		t.Fatalf("comments = %v, want 11 with a failed 111, then 20", got)
+	}
+
+	fb.setFailing(111, false)
+	_, resp = retry("id=1&ids=11")
+	if resp.Partial || len(resp.Comments) != 1 || commentIDs(resp.Comments[0].Kids)[0] != 111 || resp.Comments[0].Kids[0].Failed {
+		t.Fatalf("second retry = %+v, want 11 with 111 loaded", resp)
+	}
+
+	for _, query := range []string{"id=1&ids=90", "id=1&ids=2", "id=1&ids=", "id=1&ids=11,x", "id=1&ids=" + strings.Repeat("11,", threadRetryMaxIDs) + "12"} {
+		if status, _ := retry(query); status != http.StatusBadRequest {
+			t.Errorf("%.40s: status = %d, want 400", query, status)
+		}
+	}
+}
+
+func TestThreadView(t *testing.T) {
+	items := threadFixture()
+	for _, item := range items {
+		switch item.ID {
+		case 12:
+			item.Dead = true
+		case 20:
+			item.Deleted, item.By, item.Text = true, "", ""
+		}
+	}
+	s, _ := newFakeFirebaseServer(t, items...)
+
+	_, thread := getThread(t, s, "id=1&sort=newest")
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{30, 20, 10}) {
+		t.Errorf("newest roots = %v", got)
+	}
+	if got := commentIDs(thread.Comments[2].Kids); !reflect.DeepEqual(got, []int{12, 11}) {
+		t.Errorf("newest replies to 10 = %v", got)
+	}
+	_, thread = getThread(t, s, "id=1&sort=size")
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{10, 30, 20}) {
+		t.Errorf("size roots = %v", got)
+	}
+
+	_, thread = getThread(t, s, "id=1&hide_dead=true")
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{10, 30}) {
+		t.Errorf("live roots = %v", got)
+	}
+	if got := commentIDs(thread.Comments[0].Kids); !reflect.DeepEqual(got, []int{11}) {
+		t.Errorf("live replies to 10 = %v", got)
+	}
+
+	_, thread = getThread(t, s, "id=1&op=1")
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{10}) || thread.Comments[0].Matched {
+		t.Fatalf("op roots = %v, want 10 as context only", got)
+	}
+	if op := thread.Comments[0].Kids; len(op) != 1 || op[0].ID != 11 || !op[0].Matched || len(op[0].Kids) != 0 {
+		t.Errorf("op comments under 10 = %v, want just 11", commentIDs(op))
+	}
+
+	_, thread = getThread(t, s, "id=1&by=ALICE&q=Comment+31")
+	if got := commentIDs(thread.Comments); !reflect.DeepEqual(got, []int{30}) || commentIDs(thread.Comments[0].Kids)[0] != 31 {
+		t.Errorf("alice on 31 = %v", got)
+	}
+
+	for _, query := range []string{"id=1&sort=best", "id=1&hide_dead=maybe", "id=1&op=1&by=alice", "id=1&sort=newest&format=ndjson"} {
+		if status, _ := getThread(t, s, query); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, status)
+		}
+	}
+}
+
+func TestCommentPlainText(t *testing.T) {
+	if got := commentPlainText(`Tom &amp; Jerry<p>said <a href="https://x.example">hi</a>`); got != "Tom & Jerry said hi" {
+		t.Fatalf("plain text = %q", got)
+	}
+}
+
+func TestThreadStatistics(t *testing.T) {
+	s, _ := newFakeFirebaseServer(t, threadFixture()...)
+
+	_, thread := getThread(t, s, "id=1")
+	first := thread.Comments[0]
+	if first.LoadedDescendants != 3 || first.MaxDepth != 2 || first.NewestReply != 1_700_000_111 || first.Participants != 4 {
+		t.Errorf("10 = loaded descendants %d depth %d newest %d participants %d, want 3, 2, 1700000111, 4",
+			first.LoadedDescendants, first.MaxDepth, first.NewestReply, first.Participants)
+	}
+	if leaf := thread.Comments[1]; leaf.LoadedDescendants != 0 || leaf.MaxDepth != 0 || leaf.NewestReply != 0 || leaf.Participants != 1 {
+		t.Errorf("leaf 20 = %+v", leaf)
+	}
+	want := threadParticipants{Count: 5, Comments: 7, OPComments: 1, Top: []participantCount{
+		{By: "alice", Comments: 2}, {By: "bob", Comments: 2}, {By: "carol", Comments: 1}, {By: "dave", Comments: 1}, {By: "op", Comments: 1},
+	}}
+	if !reflect.DeepEqual(thread.Participants, want) {
+		t.Errorf("participants = %+v, want %+v", thread.Participants, want)
+	}
+
+	_, thread = getThread(t, s, "id=1&depth=1")
+	if collapsed := thread.Comments[0]; collapsed.LoadedDescendants != 2 || collapsed.MaxDepth != 1 || collapsed.Participants != 1 {
+		t.Errorf("collapsed 10 = loaded descendants %d depth %d participants %d, want 2, 1, 1", collapsed.LoadedDescendants, collapsed.MaxDepth, collapsed.Participants)
+	}
+
+	_, thread = getThread(t, s, "id=1&by=bob")
+	if got := thread.Comments[0]; got.LoadedDescendants != 3 || thread.Participants.Count != 5 {
+		t.Errorf("filtered thread changed the statistics: loaded descendants %d participants %d", got.LoadedDescendants, thread.Participants.Count)
+	}
+}